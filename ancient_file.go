@@ -0,0 +1,92 @@
+package gethdatalayer
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// ancientFile is an index or data file of a freezer table. It is read with
+// positional reads or, if it is memory mapped, by slicing the mapping without
+// any syscall or copy.
+type ancientFile struct {
+	f *os.File
+
+	// size is the size of the file when it was opened
+	size int64
+
+	// mapping is the content of the file if it is memory mapped
+	mapping []byte
+	mapped  bool
+}
+
+func openAncientFile(name string, mmap bool) (*ancientFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	file := &ancientFile{
+		f:      f,
+		size:   stat.Size(),
+		mapped: mmap,
+	}
+	if mmap && file.size > 0 {
+		if file.mapping, err = mmapFile(f, file.size); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to mmap %s: %v", name, err)
+		}
+	}
+	return file, nil
+}
+
+func (a *ancientFile) Name() string {
+	return a.f.Name()
+}
+
+// slice returns 'size' bytes at offset 'off'. If the file is memory mapped the
+// slice points to the mapping, it must not be modified and it is only valid
+// until the file is closed.
+func (a *ancientFile) slice(off int64, size int64) ([]byte, error) {
+	if !a.mapped {
+		buf := make([]byte, size)
+		if _, err := a.f.ReadAt(buf, off); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	if off < 0 || off+size > int64(len(a.mapping)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return a.mapping[off : off+size : off+size], nil
+}
+
+// readAt reads len(buf) bytes at offset 'off' into buf
+func (a *ancientFile) readAt(buf []byte, off int64) error {
+	if !a.mapped {
+		_, err := a.f.ReadAt(buf, off)
+		return err
+	}
+	if off < 0 || off+int64(len(buf)) > int64(len(a.mapping)) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(buf, a.mapping[off:])
+	return nil
+}
+
+func (a *ancientFile) Close() error {
+	var err error
+	if a.mapping != nil {
+		err = munmapFile(a.mapping)
+		a.mapping = nil
+	}
+	if fErr := a.f.Close(); fErr != nil && err == nil {
+		err = fErr
+	}
+	return err
+}
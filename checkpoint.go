@@ -0,0 +1,197 @@
+package gethdatalayer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkpointRetries is the number of attempts to create a checkpoint while
+// the database is being compacted
+const checkpointRetries = 5
+
+// errCheckpointChanged is returned if the state of the database changed
+// while the checkpoint was being copied
+var errCheckpointChanged = errors.New("database changed while copying")
+
+// checkpointCopyHook is called after the state files are copied (for tests)
+var checkpointCopyHook func()
+
+// createCheckpoint copies the key-value database in 'path' to a new temporary
+// directory in 'dir' (the default temporary directory if empty) and returns its
+// path. The table files are immutable and they are hard linked, or copied if that
+// fails and 'copyTables' is set. It does not require the lock of the database so
+// it works while geth is running.
+func createCheckpoint(path, dir string, copyTables bool) (string, error) {
+	for i := 0; i < checkpointRetries; i++ {
+		target, err := os.MkdirTemp(dir, "chaindata-checkpoint-")
+		if err != nil {
+			return "", fmt.Errorf("failed to create checkpoint dir: %v", err)
+		}
+		err = copyCheckpoint(path, target, copyTables)
+		if err == nil {
+			return target, nil
+		}
+		if rErr := os.RemoveAll(target); rErr != nil {
+			return "", rErr
+		}
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errCheckpointChanged) {
+			return "", fmt.Errorf("failed to create checkpoint: %v", err)
+		}
+		// a file was removed or a new manifest was written by a
+		// compaction while copying, try again
+	}
+	return "", fmt.Errorf("failed to create checkpoint after %d attempts", checkpointRetries)
+}
+
+func copyCheckpoint(path, target string, copyTables bool) error {
+	// copy first the files that point to the current state of the database
+	// (CURRENT, MANIFEST, OPTIONS and pebble markers). The table and log files
+	// they refer to are not removed until a newer state is written, which is
+	// detected at the end by comparing the state files before and after the copy.
+	state, err := readCheckpointState(path)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(filepath.Join(path, "CURRENT"), filepath.Join(target, "CURRENT")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// list the files after CURRENT is copied so that the manifest it points to is included
+	names, err := readDirNames(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == "CURRENT" || !isCheckpointStateFile(name) {
+			continue
+		}
+		if err := copyFile(filepath.Join(path, name), filepath.Join(target, name)); err != nil {
+			return err
+		}
+	}
+
+	// list the files again to include the tables and logs created
+	// while the state files were copied
+	if names, err = readDirNames(path); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if isCheckpointStateFile(name) || name == "LOG" || name == "LOG.old" {
+			// the info logs of leveldb are not required
+			continue
+		}
+		src, dst := filepath.Join(path, name), filepath.Join(target, name)
+		if isTableFile(name) {
+			err = linkFile(src, dst, copyTables)
+		} else {
+			err = copyFile(src, dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if checkpointCopyHook != nil {
+		checkpointCopyHook()
+	}
+
+	// a new manifest or a manifest edit (i.e. a compaction that removes tables)
+	// means that the copied state might refer to files that were not copied
+	newState, err := readCheckpointState(path)
+	if err != nil {
+		return err
+	}
+	if newState != state {
+		return errCheckpointChanged
+	}
+	return nil
+}
+
+// readCheckpointState returns the content of CURRENT and the names and sizes of
+// the other state files. It changes whenever a new state of the database is written.
+func readCheckpointState(path string) (string, error) {
+	var state strings.Builder
+
+	current, err := os.ReadFile(filepath.Join(path, "CURRENT"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	state.Write(current)
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == "CURRENT" || !isCheckpointStateFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&state, "\n%s:%d", entry.Name(), info.Size())
+	}
+	return state.String(), nil
+}
+
+func isCheckpointStateFile(name string) bool {
+	return name == "CURRENT" ||
+		strings.HasPrefix(name, "MANIFEST-") ||
+		strings.HasPrefix(name, "OPTIONS-") ||
+		strings.HasPrefix(name, "marker.")
+}
+
+func isTableFile(name string) bool {
+	return strings.HasSuffix(name, ".ldb") || strings.HasSuffix(name, ".sst")
+}
+
+// readDirNames returns the names of the files in 'path', skipping the directories
+// (i.e. the ancient store)
+func readDirNames(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// linkFile hard links 'src' to 'dst'. If it fails (i.e. the files are in
+// different filesystems) the file is copied only if 'fallback' is set.
+func linkFile(src, dst string, fallback bool) error {
+	err := os.Link(src, dst)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if !fallback {
+		return fmt.Errorf("failed to hard link table file, use WithCheckpointCopy to copy it instead: %v", err)
+	}
+	return copyFile(src, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
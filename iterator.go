@@ -1,7 +1,111 @@
 package gethdatalayer
 
+import "math/big"
+
 type Iterator interface {
 	Seek(num uint64)
 	Next() bool
 	Value() (*Block, error)
+
+	// Raw returns a lazy view over the rlp encoded parts of the current
+	// block. The view is reused, it is only valid until the next call to Next.
+	Raw() (*RawBlock, error)
+
+	// Err returns the error that stopped the iteration. It is nil
+	// if Next returned false because the end of the chain was reached.
+	Err() error
+
+	// Close releases the resources held by the iterator
+	Close() error
+}
+
+// IteratorOption configures the blocks returned by an iterator
+type IteratorOption func(*iteratorConfig)
+
+// WithSenders recovers the sender of every transaction in the block and the
+// authorities of the set code transactions. If chainID is not nil, the
+// transactions must be signed for that chain.
+func WithSenders(chainID *big.Int) IteratorOption {
+	return func(c *iteratorConfig) {
+		c.recoverSenders = true
+		c.chainID = chainID
+	}
+}
+
+// WithHeaders reads the headers of the blocks. If any of WithHeaders, WithBodies,
+// WithReceipts or WithTotalDifficulty is used, only the selected parts of the
+// blocks are read and decoded and the others are nil. By default all of them
+// are read.
+func WithHeaders() IteratorOption {
+	return func(c *iteratorConfig) {
+		c.parts |= blockHeaders
+	}
+}
+
+// WithBodies reads the bodies of the blocks, see WithHeaders
+func WithBodies() IteratorOption {
+	return func(c *iteratorConfig) {
+		c.parts |= blockBodies
+	}
+}
+
+// WithReceipts reads the receipts of the blocks, see WithHeaders. The type
+// of the receipts is only set if the bodies are also read.
+func WithReceipts() IteratorOption {
+	return func(c *iteratorConfig) {
+		c.parts |= blockReceipts
+	}
+}
+
+// WithTotalDifficulty reads the total difficulty of the blocks, see WithHeaders.
+// It is nil if the node does not store it.
+func WithTotalDifficulty() IteratorOption {
+	return func(c *iteratorConfig) {
+		c.parts |= blockTotalDifficulty
+	}
+}
+
+// blockParts is the set of parts of a block read by an iterator
+type blockParts uint8
+
+const (
+	blockHeaders blockParts = 1 << iota
+	blockBodies
+	blockReceipts
+	blockTotalDifficulty
+)
+
+type iteratorConfig struct {
+	recoverSenders bool
+	chainID        *big.Int
+
+	// parts is the set of parts selected, all of them if empty
+	parts blockParts
+}
+
+// has returns true if the part of the block has to be read
+func (c *iteratorConfig) has(part blockParts) bool {
+	if part == blockBodies && c.recoverSenders {
+		// the senders are recovered from the transactions
+		return true
+	}
+	return c.parts == 0 || c.parts&part != 0
+}
+
+func newIteratorConfig(opts ...IteratorOption) *iteratorConfig {
+	c := &iteratorConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// apply runs the optional processing steps on a decoded block
+func (c *iteratorConfig) apply(b *Block) error {
+	if c.recoverSenders {
+		if err := b.RecoverSenders(c.chainID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
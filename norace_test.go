@@ -0,0 +1,5 @@
+//go:build !race
+
+package gethdatalayer
+
+const raceEnabled = false
@@ -0,0 +1,7 @@
+//go:build race
+
+package gethdatalayer
+
+// raceEnabled is set if the tests run with the race detector, which
+// allocates on its own
+const raceEnabled = true
@@ -0,0 +1,223 @@
+package gethdatalayer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// scanChunkSize is the number of consecutive blocks decoded by a worker
+// with the same iterator
+const scanChunkSize = 128
+
+// ScanOption configures a range scan
+type ScanOption func(*scanConfig)
+
+// WithOrdered delivers the blocks in strict block order. Blocks decoded ahead
+// of the next one are held in a reordering buffer of a few chunks per worker.
+func WithOrdered() ScanOption {
+	return func(c *scanConfig) {
+		c.ordered = true
+	}
+}
+
+// WithIteratorOptions configures the blocks decoded by the workers
+// (i.e. to recover the senders in parallel)
+func WithIteratorOptions(opts ...IteratorOption) ScanOption {
+	return func(c *scanConfig) {
+		c.iteratorOpts = append(c.iteratorOpts, opts...)
+	}
+}
+
+type scanConfig struct {
+	ordered      bool
+	iteratorOpts []IteratorOption
+}
+
+type scanResult struct {
+	block *Block
+	err   error
+}
+
+// scanChunk is a range of blocks [from, to) decoded by a single worker
+type scanChunk struct {
+	from, to uint64
+	results  chan scanResult
+}
+
+// ScanRange decodes the blocks [from, to) with 'workers' goroutines and calls fn
+// for each of them. By default the blocks are delivered as soon as they are
+// decoded, use WithOrdered to receive them in block order. fn is never called
+// concurrently. The scan stops at the first error returned by fn, the first
+// block that cannot be read or when the context is cancelled.
+func (s *Store) ScanRange(ctx context.Context, from, to uint64, workers int, fn func(*Block) error, opts ...ScanOption) error {
+	config := &scanConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if from >= to {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	// the chunks are handed to the workers in order. In ordered mode, they are
+	// also queued in the same order so that they are drained one after the other.
+	chunks := make(chan *scanChunk)
+	queue := make(chan *scanChunk, workers)
+
+	// in unordered mode all the workers share the same results channel
+	results := make(chan scanResult, workers)
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(chunks)
+		defer close(queue)
+
+		for start := from; start < to; start += scanChunkSize {
+			chunk := &scanChunk{
+				from:    start,
+				to:      start + scanChunkSize,
+				results: results,
+			}
+			if chunk.to > to {
+				chunk.to = to
+			}
+			if config.ordered {
+				chunk.results = make(chan scanResult, chunk.to-chunk.from)
+			}
+			select {
+			case chunks <- chunk:
+			case <-ctx.Done():
+				return
+			}
+			if config.ordered {
+				select {
+				case queue <- chunk:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	var workersWg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			s.scanWorker(ctx, chunks, config)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		workersWg.Wait()
+		close(results)
+	}()
+
+	handle := func(res scanResult) error {
+		if err := ctx.Err(); err != nil {
+			// do not deliver more blocks once the scan is cancelled
+			return err
+		}
+		if res.err != nil {
+			return res.err
+		}
+		return fn(res.block)
+	}
+
+	if !config.ordered {
+		for {
+			select {
+			case res, ok := <-results:
+				if !ok {
+					return nil
+				}
+				if err := handle(res); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	for {
+		var chunk *scanChunk
+		var ok bool
+		select {
+		case chunk, ok = <-queue:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !ok {
+			return ctx.Err()
+		}
+		for num := chunk.from; num < chunk.to; num++ {
+			select {
+			case res, ok := <-chunk.results:
+				if !ok {
+					// the worker stopped because the scan was cancelled
+					return ctx.Err()
+				}
+				if err := handle(res); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// scanWorker decodes the chunks with its own iterator until there
+// are no more chunks or the scan is cancelled
+func (s *Store) scanWorker(ctx context.Context, chunks chan *scanChunk, config *scanConfig) {
+	iter := s.Iterator(config.iteratorOpts...)
+	defer iter.Close()
+
+	for chunk := range chunks {
+		if !s.scanChunk(ctx, iter, chunk, config) {
+			return
+		}
+	}
+}
+
+// scanChunk sends the blocks of the chunk to its results channel. It returns
+// false if the scan has to stop.
+func (s *Store) scanChunk(ctx context.Context, iter Iterator, chunk *scanChunk, config *scanConfig) bool {
+	if config.ordered {
+		defer close(chunk.results)
+	}
+
+	iter.Seek(chunk.from)
+	for num := chunk.from; num < chunk.to; num++ {
+		var res scanResult
+		if iter.Next() {
+			res.block, res.err = iter.Value()
+		} else if res.err = iter.Err(); res.err == nil {
+			res.err = fmt.Errorf("block %d: %w", num, ErrBlockNotFound)
+		}
+
+		select {
+		case chunk.results <- res:
+		case <-ctx.Done():
+			return false
+		}
+		if res.err != nil {
+			return false
+		}
+	}
+	return true
+}
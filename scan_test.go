@@ -0,0 +1,100 @@
+package gethdatalayer
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func newMockScanStore(t *testing.T) *Store {
+	t.Helper()
+
+	// blocks [0, 300) are in the ancient store and [300, 500) in the kv store
+	ancientStore, err := NewAncientStore(newMockAncientStore(t, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStoreFromKV(newMockMemoryStore(300, 500), ancientStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func TestScanRange_Ordered(t *testing.T) {
+	store := newMockScanStore(t)
+
+	next := uint64(10)
+	err := store.ScanRange(context.Background(), 10, 490, 4, func(b *Block) error {
+		if b.Number != next {
+			t.Fatalf("expected block %d but found %d", next, b.Number)
+		}
+		next++
+		return nil
+	}, WithOrdered())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 490 {
+		t.Fatalf("expected to scan up to block 490 but stopped at %d", next)
+	}
+}
+
+func TestScanRange_Unordered(t *testing.T) {
+	store := newMockScanStore(t)
+
+	found := map[uint64]bool{}
+	err := store.ScanRange(context.Background(), 0, 500, 8, func(b *Block) error {
+		if found[b.Number] {
+			t.Fatalf("block %d found twice", b.Number)
+		}
+		found[b.Number] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 500 {
+		t.Fatalf("expected 500 blocks but found %d", len(found))
+	}
+}
+
+func TestScanRange_Errors(t *testing.T) {
+	store := newMockScanStore(t)
+
+	// the range goes beyond the end of the chain
+	err := store.ScanRange(context.Background(), 400, 600, 4, func(b *Block) error {
+		return nil
+	}, WithOrdered())
+	if !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("expected block not found but found %v", err)
+	}
+
+	// the error of the callback stops the scan
+	errStop := errors.New("stop")
+	count := 0
+	err = store.ScanRange(context.Background(), 0, 500, 4, func(b *Block) error {
+		if count++; count == 50 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("expected stop error but found %v", err)
+	}
+
+	// the scan is cancelled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	err = store.ScanRange(ctx, 0, 500, 4, func(b *Block) error {
+		if b.Number == 100 {
+			cancel()
+		}
+		return nil
+	}, WithOrdered())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context cancelled but found %v", err)
+	}
+}
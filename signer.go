@@ -0,0 +1,215 @@
+package gethdatalayer
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/umbracle/fastrlp"
+)
+
+var (
+	secp256k1N     = secp256k1.S256().N
+	secp256k1HalfN = new(big.Int).Rsh(secp256k1N, 1)
+)
+
+// validateSignatureValues checks the r, s values of a signature. If homestead
+// is set the s value must be in the lower half of the curve order (eip-2).
+func validateSignatureValues(r, s *big.Int, homestead bool) error {
+	if r.Sign() <= 0 || s.Sign() <= 0 {
+		return fmt.Errorf("invalid signature: zero values")
+	}
+	if r.Cmp(secp256k1N) >= 0 || s.Cmp(secp256k1N) >= 0 {
+		return fmt.Errorf("invalid signature: values out of range")
+	}
+	if homestead && s.Cmp(secp256k1HalfN) > 0 {
+		return fmt.Errorf("invalid signature: s value in the upper half of the curve order")
+	}
+	return nil
+}
+
+// ecrecover returns the address that signed 'sighash' with the signature values r, s
+// and the recovery id (0 or 1)
+func ecrecover(sighash []byte, r, s *big.Int, recoveryID byte, homestead bool) (address, error) {
+	if recoveryID > 1 {
+		return address{}, fmt.Errorf("invalid signature: recovery id %d", recoveryID)
+	}
+	if err := validateSignatureValues(r, s, homestead); err != nil {
+		return address{}, err
+	}
+
+	// compact signature format: [27 + recovery id] [R] [S]
+	sig := make([]byte, 65)
+	sig[0] = 27 + recoveryID
+	r.FillBytes(sig[1:33])
+	s.FillBytes(sig[33:])
+
+	pub, _, err := ecdsa.RecoverCompact(sig, sighash)
+	if err != nil {
+		return address{}, err
+	}
+
+	// the address is the last 20 bytes of the hash of the uncompressed public key
+	keccak := fastrlp.NewKeccak256()
+	keccak.Write(pub.SerializeUncompressed()[1:])
+	buf := keccak.Sum(nil)
+
+	var addr address
+	copy(addr[:], buf[12:])
+	return addr, nil
+}
+
+// signingHash returns the keccak hash of the optional type prefix and the rlp value
+func signingHash(prefix []byte, v *fastrlp.Value) []byte {
+	keccak := fastrlp.NewKeccak256()
+	keccak.Write(prefix)
+	keccak.Write(v.MarshalTo(nil))
+	return keccak.Sum(nil)
+}
+
+// Sender recovers the address that signed the transaction. If chainID is not nil
+// it must match the chain id of the transaction. Legacy transactions signed before
+// eip-155 are not bound to any chain.
+func (t *Transaction) Sender(chainID *big.Int) (address, error) {
+	r := new(big.Int).SetBytes(t.R)
+	s := new(big.Int).SetBytes(t.S)
+	v := new(big.Int).SetBytes(t.V)
+
+	if t.Type == TransactionLegacy {
+		if v.BitLen() <= 8 && (v.Uint64() == 27 || v.Uint64() == 28) {
+			// pre eip-155, frontier transactions are not checked for malleability
+			return ecrecover(t.legacySigningHash(nil), r, s, byte(v.Uint64()-27), false)
+		}
+
+		// eip-155: v = chain_id * 2 + 35 + recovery id
+		if v.Cmp(big.NewInt(35)) < 0 {
+			return address{}, fmt.Errorf("invalid signature: v value %s", v)
+		}
+		txChainID := new(big.Int).Sub(v, big.NewInt(35))
+		recoveryID := byte(txChainID.Bit(0))
+		txChainID.Rsh(txChainID, 1)
+
+		if chainID != nil && chainID.Cmp(txChainID) != 0 {
+			return address{}, fmt.Errorf("invalid chain id, expected %s but found %s", chainID, txChainID)
+		}
+		return ecrecover(t.legacySigningHash(txChainID), r, s, recoveryID, true)
+	}
+
+	if chainID != nil && chainID.Cmp(t.ChainID) != 0 {
+		return address{}, fmt.Errorf("invalid chain id, expected %s but found %s", chainID, t.ChainID)
+	}
+	if v.BitLen() > 1 {
+		return address{}, fmt.Errorf("invalid signature: y parity %s", v)
+	}
+	return ecrecover(t.typedSigningHash(), r, s, byte(v.Uint64()), true)
+}
+
+// RecoverAuthorities sets the authority of every authorization of a set code
+// transaction. The authorizations with an invalid signature have no authority.
+func (t *Transaction) RecoverAuthorities() {
+	for _, auth := range t.AuthorizationList {
+		auth.Authority = nil
+		if authority, err := auth.recoverAuthority(); err == nil {
+			auth.Authority = &authority
+		}
+	}
+}
+
+// legacySigningHash returns the hash signed by a legacy transaction. If
+// chainID is not nil, it follows eip-155.
+func (t *Transaction) legacySigningHash(chainID *big.Int) []byte {
+	a := &fastrlp.Arena{}
+
+	v := a.NewArray()
+	v.Set(a.NewUint(t.Nonce))
+	v.Set(a.NewUint(t.GasPrice))
+	v.Set(a.NewUint(t.Gas))
+	v.Set(t.marshalTo(a))
+	v.Set(a.NewBigInt(t.Value))
+	v.Set(a.NewCopyBytes(t.Input))
+
+	if chainID != nil {
+		v.Set(a.NewBigInt(chainID))
+		v.Set(a.NewUint(0))
+		v.Set(a.NewUint(0))
+	}
+	return signingHash(nil, v)
+}
+
+// typedSigningHash returns the hash signed by a typed (eip-2718) transaction
+func (t *Transaction) typedSigningHash() []byte {
+	a := &fastrlp.Arena{}
+
+	v := a.NewArray()
+	v.Set(a.NewBigInt(t.ChainID))
+	v.Set(a.NewUint(t.Nonce))
+
+	if t.Type == TransactionAccessList {
+		v.Set(a.NewUint(t.GasPrice))
+	} else {
+		v.Set(a.NewBigInt(t.MaxPriorityFeePerGas))
+		v.Set(a.NewBigInt(t.MaxFeePerGas))
+	}
+
+	v.Set(a.NewUint(t.Gas))
+	v.Set(t.marshalTo(a))
+	v.Set(a.NewBigInt(t.Value))
+	v.Set(a.NewCopyBytes(t.Input))
+	v.Set(t.AccessList.MarshalRLPWith(a))
+
+	if t.Type == TransactionBlob {
+		v.Set(a.NewBigInt(t.MaxFeePerBlobGas))
+
+		hashes := a.NewArray()
+		for _, h := range t.BlobVersionedHashes {
+			hashes.Set(a.NewCopyBytes(h[:]))
+		}
+		v.Set(hashes)
+	}
+	if t.Type == TransactionSetCode {
+		v.Set(t.AuthorizationList.MarshalRLPWith(a))
+	}
+	return signingHash([]byte{byte(t.Type)}, v)
+}
+
+func (t *Transaction) marshalTo(a *fastrlp.Arena) *fastrlp.Value {
+	if t.To == nil {
+		// contract creation
+		return a.NewNull()
+	}
+	return a.NewCopyBytes(t.To[:])
+}
+
+func (a *AccessList) MarshalRLPWith(arena *fastrlp.Arena) *fastrlp.Value {
+	v := arena.NewArray()
+	for _, entry := range *a {
+		acct := arena.NewArray()
+		acct.Set(arena.NewCopyBytes(entry.Address[:]))
+
+		storage := arena.NewArray()
+		for _, key := range entry.Storage {
+			storage.Set(arena.NewCopyBytes(key[:]))
+		}
+		acct.Set(storage)
+
+		v.Set(acct)
+	}
+	return v
+}
+
+func (a *AuthorizationList) MarshalRLPWith(arena *fastrlp.Arena) *fastrlp.Value {
+	v := arena.NewArray()
+	for _, auth := range *a {
+		elem := arena.NewArray()
+		elem.Set(arena.NewBigInt(auth.ChainID))
+		elem.Set(arena.NewCopyBytes(auth.Address[:]))
+		elem.Set(arena.NewUint(auth.Nonce))
+		elem.Set(arena.NewUint(uint64(auth.V)))
+		elem.Set(arena.NewBigInt(auth.R))
+		elem.Set(arena.NewBigInt(auth.S))
+
+		v.Set(elem)
+	}
+	return v
+}
@@ -1,80 +1,409 @@
 package gethdatalayer
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
 )
 
+// ErrBlockNotFound is returned when the block is not in the canonical chain
+// or its hash is not known
+var ErrBlockNotFound = errors.New("block not found")
+
 type Store struct {
-	leveldbStore *LevelDbStore
+	kvStore      KeyValueReader
 	ancientStore *AncientStore
+
+	// ancientLimit is the first block that is not read from the ancient store
+	ancientLimit uint64
+
+	// checkpoint is the copy of the kv store removed on Close
+	checkpoint string
+}
+
+const (
+	engineLevelDb = "leveldb"
+	enginePebble  = "pebble"
+)
+
+// detectEngine returns the database engine used in 'path'. Pebble always
+// writes an OPTIONS file while leveldb tracks its manifest in CURRENT.
+func detectEngine(path string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(path, "OPTIONS*"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) > 0 {
+		return enginePebble, nil
+	}
+	if _, err := os.Stat(filepath.Join(path, "CURRENT")); err != nil {
+		return "", fmt.Errorf("no database found in %s: %v", path, err)
+	}
+	return engineLevelDb, nil
 }
 
-func NewStore(path string) (*Store, error) {
-	// load the kv store
-	leveldbStore, err := NewLevelDBStore(path)
+func newKvStore(path string) (kvStore, error) {
+	engine, err := detectEngine(path)
 	if err != nil {
 		return nil, err
 	}
+	if engine == enginePebble {
+		return NewPebbleStore(path)
+	}
+	return NewLevelDBStore(path)
+}
+
+// StoreOption configures how the store is opened
+type StoreOption func(*storeConfig)
+
+// WithCheckpoint opens a copy of the key-value database created in a temporary
+// directory inside 'dir' (the default temporary directory if empty), so that it
+// can be read while geth is running and holds the lock of the database. The
+// ancient store is read in place up to the items frozen when it is opened.
+// The copy is removed on Close.
+//
+// The table files are hard linked, so 'dir' has to be in the same filesystem
+// as the database. Otherwise it fails unless WithCheckpointCopy is set.
+func WithCheckpoint(dir string) StoreOption {
+	return func(c *storeConfig) {
+		c.checkpoint = true
+		c.checkpointDir = dir
+	}
+}
+
+// WithCheckpointCopy copies the table files of the checkpoint if they cannot
+// be hard linked (i.e. the checkpoint is in a different filesystem). Copying
+// the whole database can take a long time and requires as much disk space.
+func WithCheckpointCopy() StoreOption {
+	return func(c *storeConfig) {
+		c.checkpointCopy = true
+	}
+}
+
+// WithAncientOptions configures how the ancient store is read (i.e. WithMmap)
+func WithAncientOptions(opts ...AncientOption) StoreOption {
+	return func(c *storeConfig) {
+		c.ancientOpts = append(c.ancientOpts, opts...)
+	}
+}
+
+type storeConfig struct {
+	checkpoint     bool
+	checkpointDir  string
+	checkpointCopy bool
+	ancientOpts    []AncientOption
+}
+
+func NewStore(path string, opts ...StoreOption) (*Store, error) {
+	config := &storeConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
 
-	// load the ancient store
-	ancientStore, err := NewAncientStore(filepath.Join(path, "ancient/chain"))
+	kvPath := path
+	if config.checkpoint {
+		checkpoint, err := createCheckpoint(path, config.checkpointDir, config.checkpointCopy)
+		if err != nil {
+			return nil, err
+		}
+		kvPath = checkpoint
+	}
+
+	s, err := newStore(path, kvPath, config)
 	if err != nil {
+		if config.checkpoint {
+			os.RemoveAll(kvPath)
+		}
 		return nil, err
 	}
+	if config.checkpoint {
+		s.checkpoint = kvPath
+	}
+	return s, nil
+}
 
-	// figure out if there is a stream between the last block we can
-	// read from ancient store and the leveldb
-	lastAncientBlock := ancientStore.LastNum()
+func newStore(path, kvPath string, config *storeConfig) (*Store, error) {
+	ancientConfig := &ancientConfig{
+		live: config.checkpoint,
+	}
+	for _, opt := range config.ancientOpts {
+		opt(ancientConfig)
+	}
+	if ancientConfig.live && ancientConfig.mmap {
+		// geth might truncate the files while they are mapped
+		return nil, fmt.Errorf("the freezer cannot be memory mapped with a checkpoint of a running node")
+	}
+
+	// load the kv store (leveldb or pebble)
+	kvStore, err := newKvStore(kvPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// load the ancient store after the kv store, geth writes the blocks
+	// to the freezer before deleting them from the kv store
+	ancientStore, err := newAncientStore(filepath.Join(path, "ancient/chain"), ancientConfig)
+	if err != nil {
+		kvStore.Close()
+		return nil, err
+	}
 
-	if _, err := decodeBlock(leveldbStore, lastAncientBlock+1); err != nil {
+	s, err := NewStoreFromKV(kvStore, ancientStore)
+	if err != nil {
+		kvStore.Close()
+		ancientStore.Close()
 		return nil, err
 	}
+	return s, nil
+}
 
+// NewStoreFromKV creates a store on top of any key-value database and an
+// optional ancient store. The store takes ownership of both and closes
+// them on Close.
+func NewStoreFromKV(kv KeyValueReader, ancientStore *AncientStore) (*Store, error) {
 	s := &Store{
-		leveldbStore: leveldbStore,
+		kvStore:      kv,
 		ancientStore: ancientStore,
 	}
+	if ancientStore != nil {
+		s.ancientLimit = ancientStore.LastNum()
+	}
+
+	// figure out if there is a stream between the last block we can
+	// read from ancient store and the kv store
+	if _, err := decodeBlock(kv, s.ancientLimit); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
-func (s *Store) Iterator() Iterator {
+// Snapshot returns a view of the store at this point in time. The key-value
+// reads come from a snapshot of the database and the ancient reads are limited
+// to the items frozen when the snapshot is taken. Closing the snapshot does
+// not close the store.
+func (s *Store) Snapshot() (*Store, error) {
+	snapshotter, ok := s.kvStore.(kvSnapshotter)
+	if !ok {
+		return nil, fmt.Errorf("key-value store does not support snapshots")
+	}
+	// geth writes the blocks to the freezer before deleting them from the
+	// key-value store, pin the database first so that there are no gaps
+	kv, err := snapshotter.kvSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	snap := &Store{
+		kvStore:      kv,
+		ancientLimit: s.lastAncientNum(),
+	}
+	if s.ancientStore != nil {
+		// the blocks frozen since the store was opened might not be in the
+		// key-value snapshot anymore, open the freezer again to read the
+		// current number of items of the tables
+		if snap.ancientStore, err = s.ancientStore.reopen(); err != nil {
+			if closer, ok := kv.(interface{ Close() error }); ok {
+				closer.Close()
+			}
+			return nil, err
+		}
+		snap.ancientLimit = snap.ancientStore.LastNum()
+	}
+	return snap, nil
+}
+
+// Close closes the kv and ancient stores
+func (s *Store) Close() error {
+	var lErr, aErr error
+	if closer, ok := s.kvStore.(interface{ Close() error }); ok {
+		lErr = closer.Close()
+	}
+	if s.ancientStore != nil {
+		aErr = s.ancientStore.Close()
+	}
+	if s.checkpoint != "" {
+		if err := os.RemoveAll(s.checkpoint); err != nil && lErr == nil {
+			lErr = err
+		}
+	}
+	if lErr != nil {
+		return lErr
+	}
+	return aErr
+}
+
+// lastAncientNum returns the first block that is not in the ancient store
+func (s *Store) lastAncientNum() uint64 {
+	return s.ancientLimit
+}
+
+// FirstNum returns the first block with a body and receipts available,
+// which is not zero if the ancient store was pruned
+func (s *Store) FirstNum() uint64 {
+	if s.lastAncientNum() == 0 {
+		return 0
+	}
+	return s.ancientStore.FirstNum()
+}
+
+func (s *Store) GetBlockByNumber(num uint64) (*Block, error) {
+	if num < s.lastAncientNum() {
+		return s.ancientStore.GetBlockByNumber(num)
+	}
+	return decodeBlock(s.kvStore, num)
+}
+
+// GetHeaderByHash returns the header with the given hash. The header does not
+// need to be part of the canonical chain.
+func (s *Store) GetHeaderByHash(h hash) (*Header, error) {
+	num, canonical, err := s.readHashNumber(h)
+	if err != nil {
+		return nil, err
+	}
+	if canonical {
+		return s.ancientStore.GetHeaderByNumber(num)
+	}
+	return decodeHeader(s.kvStore, num, h[:])
+}
+
+// GetBlockByHash returns the block with the given hash. The block does not
+// need to be part of the canonical chain.
+func (s *Store) GetBlockByHash(h hash) (*Block, error) {
+	num, canonical, err := s.readHashNumber(h)
+	if err != nil {
+		return nil, err
+	}
+	if canonical {
+		return s.ancientStore.GetBlockByNumber(num)
+	}
+	return decodeBlockWithHash(s.kvStore, num, h[:], &iteratorConfig{})
+}
+
+// readHashNumber returns the number of the block with the given hash and
+// whether it is a canonical block in the ancient store. The ancient store only
+// holds the canonical chain, a side chain block with the same number might
+// still live in the kv store.
+func (s *Store) readHashNumber(h hash) (uint64, bool, error) {
+	num, err := decodeHeaderNumber(s.kvStore, h[:])
+	if errors.Is(err, ErrNotFound) {
+		return 0, false, ErrBlockNotFound
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if num >= s.lastAncientNum() {
+		return num, false, nil
+	}
+	canonical, err := s.ancientStore.CanonicalHash(num)
+	if err != nil {
+		return 0, false, err
+	}
+	return num, canonical == h, nil
+}
+
+// Head returns the header of the latest full block, which is the upper
+// bound for the iterator
+func (s *Store) Head() (*Header, error) {
+	return s.readHeadMarker(headBlockKey)
+}
+
+// LastHeader returns the latest known header. It is ahead of the
+// head block while the node is still syncing.
+func (s *Store) LastHeader() (*Header, error) {
+	return s.readHeadMarker(headHeaderKey)
+}
+
+// LastFast returns the header of the latest block downloaded during snap sync
+func (s *Store) LastFast() (*Header, error) {
+	return s.readHeadMarker(headFastBlockKey)
+}
+
+// LastFinalized returns the header of the latest finalized block
+func (s *Store) LastFinalized() (*Header, error) {
+	return s.readHeadMarker(headFinalizedBlockKey)
+}
+
+// Syncing returns true if the node knows about headers ahead of the head block
+func (s *Store) Syncing() (bool, error) {
+	head, err := s.Head()
+	if err != nil {
+		return false, err
+	}
+	lastHeader, err := s.LastHeader()
+	if err != nil {
+		return false, err
+	}
+	return lastHeader.Number > head.Number, nil
+}
+
+func (s *Store) readHeadMarker(key []byte) (*Header, error) {
+	hashB, err := s.kvStore.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read head marker %s: %w", string(key), err)
+	}
+	if len(hashB) != 32 {
+		return nil, fmt.Errorf("incorrect hash length: %d", len(hashB))
+	}
+
+	var h hash
+	copy(h[:], hashB)
+	return s.GetHeaderByHash(h)
+}
+
+func (s *Store) Iterator(opts ...IteratorOption) Iterator {
 	iter := &storeIterator{
 		store:          s,
-		lastAncientNum: s.ancientStore.LastNum(),
+		opts:           opts,
+		num:            s.FirstNum(),
+		lastAncientNum: s.lastAncientNum(),
 	}
 	return iter
 }
 
 type storeIterator struct {
 	store          *Store
+	opts           []IteratorOption
 	num            uint64
 	lastAncientNum uint64
-	iterLevelDb    Iterator
+	iterKv         Iterator
 	iterAncient    Iterator
+	err            error
 }
 
 func (s *storeIterator) Seek(num uint64) {
 	s.num = num
+	s.err = nil
+
+	// the underlying iterators are created again on the next call
+	s.closeIterators()
 }
 
 func (s *storeIterator) Next() bool {
-	if s.num+1 >= s.lastAncientNum {
-		// use the leveldb store
-		if s.iterLevelDb == nil {
-			s.iterLevelDb = s.store.leveldbStore.Iterator()
-			s.iterLevelDb.Seek(s.num)
-		}
+	if s.err != nil {
+		return false
+	}
+
+	if s.num >= s.lastAncientNum {
+		// use the kv store
 		if s.iterAncient != nil {
-			// reset the ancient iterator (TODO: Close it)
+			// release the ancient iterator
+			if err := s.iterAncient.Close(); err != nil {
+				s.err = err
+				return false
+			}
 			s.iterAncient = nil
 		}
+		if s.iterKv == nil {
+			s.iterKv = newKvIterator(s.store.kvStore, s.opts...)
+			s.iterKv.Seek(s.num)
+		}
 		s.num++
-		return s.iterLevelDb.Next()
+		return s.iterKv.Next()
 	}
 
 	// use the ancient store
 	if s.iterAncient == nil {
-		s.iterAncient = s.store.ancientStore.Iterator()
+		s.iterAncient = s.store.ancientStore.Iterator(s.opts...)
 		s.iterAncient.Seek(s.num)
 	}
 	s.num++
@@ -85,5 +414,50 @@ func (s *storeIterator) Value() (*Block, error) {
 	if s.iterAncient != nil {
 		return s.iterAncient.Value()
 	}
-	return s.iterLevelDb.Value()
+	if s.iterKv != nil {
+		return s.iterKv.Value()
+	}
+	return nil, fmt.Errorf("no value, call Next first")
+}
+
+func (s *storeIterator) Raw() (*RawBlock, error) {
+	if s.iterAncient != nil {
+		return s.iterAncient.Raw()
+	}
+	if s.iterKv != nil {
+		return s.iterKv.Raw()
+	}
+	return nil, fmt.Errorf("no value, call Next first")
+}
+
+func (s *storeIterator) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.iterAncient != nil {
+		return s.iterAncient.Err()
+	}
+	if s.iterKv != nil {
+		return s.iterKv.Err()
+	}
+	return nil
+}
+
+func (s *storeIterator) Close() error {
+	return s.closeIterators()
+}
+
+func (s *storeIterator) closeIterators() error {
+	var err error
+	if s.iterAncient != nil {
+		err = s.iterAncient.Close()
+		s.iterAncient = nil
+	}
+	if s.iterKv != nil {
+		if lErr := s.iterKv.Close(); lErr != nil && err == nil {
+			err = lErr
+		}
+		s.iterKv = nil
+	}
+	return err
 }
@@ -2,130 +2,568 @@ package gethdatalayer
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/big"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/golang/snappy"
+	"github.com/umbracle/fastrlp"
 )
 
 var _ Iterator = &ancientIterator{}
 
+var (
+	// ErrTruncatedIndex is returned when the index file of a table
+	// ends before the entries of an item
+	ErrTruncatedIndex = errors.New("truncated index")
+
+	// ErrCorruptData is returned when an item cannot be read or decoded
+	// from its data file
+	ErrCorruptData = errors.New("corrupt data")
+
+	// ErrOutOfBounds is returned when the item is not in the table
+	ErrOutOfBounds = errors.New("out of bounds")
+)
+
+// AncientError is an error reading an item from an ancient table.
+// The Err field wraps one of ErrTruncatedIndex, ErrCorruptData
+// or ErrOutOfBounds.
+type AncientError struct {
+	Table string
+	Item  uint64
+	File  string
+	Err   error
+}
+
+func (e *AncientError) Error() string {
+	return fmt.Sprintf("ancient table '%s' item %d (%s): %v", e.Table, e.Item, e.File, e.Err)
+}
+
+func (e *AncientError) Unwrap() error {
+	return e.Err
+}
+
+// AncientStore reads the blocks of the geth freezer. It only uses positional
+// reads on the files, so it is safe to read and iterate from many goroutines.
 type AncientStore struct {
+	path string
+
 	receipts *ancientTable
 	headers  *ancientTable
 	bodies   *ancientTable
+
+	// hashes is nil if the freezer does not store the canonical hashes,
+	// they are computed from the headers instead
+	hashes *ancientTable
+
+	// diffs is nil if the freezer does not store the total difficulty
+	diffs *ancientTable
+
+	// mmap is set if the files are memory mapped
+	mmap bool
+
+	// tables is the set of open tables by name
+	tables     map[string]*ancientTable
+	tablesLock sync.Mutex
 }
 
-func NewAncientStore(path string) (*AncientStore, error) {
-	receiptsTable, err := newAncientTable(path, "receipts")
-	if err != nil {
+// AncientOption configures how the ancient store reads the freezer files
+type AncientOption func(*ancientConfig)
+
+// WithMmap memory maps the index and data files of the freezer instead of
+// reading them with a syscall per item. The items of the uncompressed tables
+// returned by AncientTable.Get point to the mapping, they must not be modified
+// and they are only valid until the store is closed. The files must not be
+// truncated while they are mapped, it is not safe to use on a running node
+// and NewStore fails if it is combined with WithCheckpoint.
+func WithMmap() AncientOption {
+	return func(c *ancientConfig) {
+		c.mmap = true
+	}
+}
+
+type ancientConfig struct {
+	mmap bool
+
+	// live is set if geth might be appending items while the tables are
+	// opened, all of them are limited to the smallest number of items
+	// instead of failing
+	live bool
+}
+
+func NewAncientStore(path string, opts ...AncientOption) (*AncientStore, error) {
+	config := &ancientConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return newAncientStore(path, config)
+}
+
+func newAncientStore(path string, config *ancientConfig) (*AncientStore, error) {
+	store := &AncientStore{
+		path:   path,
+		mmap:   config.mmap,
+		tables: map[string]*ancientTable{},
+	}
+	if err := store.open(config); err != nil {
+		// close the tables opened before the error
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// open opens the tables of the blocks and checks that all of them
+// have the same number of items
+func (a *AncientStore) open(config *ancientConfig) error {
+	for _, name := range []string{"receipts", "headers", "bodies"} {
+		table, err := newAncientTable(a.path, name, config.mmap)
+		if err != nil {
+			return err
+		}
+		a.tables[name] = table
+	}
+	// the hashes are optional and newer versions of geth
+	// do not track the total difficulty
+	for _, name := range []string{"hashes", "diffs"} {
+		table, err := openOptionalAncientTable(a.path, name, config.mmap)
+		if err != nil {
+			return err
+		}
+		if table != nil {
+			a.tables[name] = table
+		}
+	}
+	a.receipts = a.tables["receipts"]
+	a.headers = a.tables["headers"]
+	a.bodies = a.tables["bodies"]
+	a.hashes = a.tables["hashes"]
+	a.diffs = a.tables["diffs"]
+
+	if config.live {
+		numItems := a.headers.numItems
+		for _, table := range a.tables {
+			if table.numItems < numItems {
+				numItems = table.numItems
+			}
+		}
+		for _, table := range a.tables {
+			table.numItems = numItems
+			if table.itemHidden > numItems {
+				table.itemHidden = numItems
+			}
+		}
+	}
+
+	// all the tables should have the same number of items
+	for _, name := range []string{"bodies", "receipts", "hashes", "diffs"} {
+		table, ok := a.tables[name]
+		if ok && table.numItems != a.headers.numItems {
+			return fmt.Errorf("header and %s table do not have same num of items", name)
+		}
+	}
+	return nil
+}
+
+// openOptionalAncientTable opens the table 'name' or returns nil
+// if the freezer does not have it
+func openOptionalAncientTable(path, name string, mmap bool) (*ancientTable, error) {
+	found, err := hasAncientTable(path, name)
+	if err != nil || !found {
 		return nil, err
 	}
-	headerTable, err := newAncientTable(path, "headers")
+	return newAncientTable(path, name, mmap)
+}
+
+// reopen opens the freezer again with the items written since the store was
+// opened. The tables are capped to the items written in all of them. Since geth
+// might be writing to the freezer, the files are not memory mapped.
+func (a *AncientStore) reopen() (*AncientStore, error) {
+	return newAncientStore(a.path, &ancientConfig{live: true})
+}
+
+// AncientTable gives raw access to the items of a freezer table
+type AncientTable struct {
+	table *ancientTable
+}
+
+// Table returns the freezer table 'name' (i.e. hashes or diffs). The
+// table is opened the first time and it is closed with the store.
+func (a *AncientStore) Table(name string) (*AncientTable, error) {
+	a.tablesLock.Lock()
+	defer a.tablesLock.Unlock()
+
+	table, ok := a.tables[name]
+	if !ok {
+		var err error
+		if table, err = newAncientTable(a.path, name, a.mmap); err != nil {
+			return nil, err
+		}
+		a.tables[name] = table
+	}
+	return &AncientTable{table: table}, nil
+}
+
+// Get returns the raw item 'num', decompressed if the table uses snappy
+func (t *AncientTable) Get(num uint64) ([]byte, error) {
+	return t.table.Get(num)
+}
+
+// NumItems returns the number of items in the table
+func (t *AncientTable) NumItems() uint64 {
+	return t.table.numItems
+}
+
+// Compressed returns whether the items are compressed with snappy
+func (t *AncientTable) Compressed() bool {
+	return t.table.compressed
+}
+
+// FirstNum returns the first block in the ancient store. It is not zero
+// if the history was pruned (i.e. pre-merge history expiry).
+func (a *AncientStore) FirstNum() uint64 {
+	first := uint64(0)
+	for _, table := range []*ancientTable{a.receipts, a.headers, a.bodies, a.hashes, a.diffs} {
+		if table != nil && table.FirstNum() > first {
+			first = table.FirstNum()
+		}
+	}
+	return first
+}
+
+// LastNum returns the number of blocks in the ancient store, which is
+// also the number of the first block that is not frozen yet
+func (a *AncientStore) LastNum() uint64 {
+	return a.headers.numItems
+}
+
+// Close closes the files of the ancient tables
+func (a *AncientStore) Close() error {
+	a.tablesLock.Lock()
+	defer a.tablesLock.Unlock()
+
+	var err error
+	for _, table := range a.tables {
+		if tErr := table.Close(); tErr != nil && err == nil {
+			err = tErr
+		}
+	}
+	return err
+}
+
+func (a *AncientStore) GetBlockByNumber(num uint64) (*Block, error) {
+	receipts := Receipts{}
+	if err := a.receipts.GetObj(num, &receipts); err != nil {
+		return nil, err
+	}
+
+	header, err := a.GetHeaderByNumber(num)
 	if err != nil {
 		return nil, err
 	}
-	bodiesTable, err := newAncientTable(path, "bodies")
+
+	body := Body{}
+	if err := a.bodies.GetObj(num, &body); err != nil {
+		return nil, err
+	}
+	block, err := newBlock(num, header, &body, &receipts)
 	if err != nil {
 		return nil, err
 	}
 
-	// all the tables should have the same number of items
-	if headerTable.numItems != bodiesTable.numItems {
-		return nil, fmt.Errorf("header and bodies table do not have same num of items")
+	if block.Hash, err = a.CanonicalHash(num); err != nil {
+		return nil, err
 	}
-	if headerTable.numItems != receiptsTable.numItems {
-		return nil, fmt.Errorf("header and receipts table do not have same num of items")
+	if block.TotalDifficulty, err = a.TotalDifficulty(num); err != nil {
+		return nil, err
 	}
+	return block, nil
+}
 
-	store := &AncientStore{
-		receipts: receiptsTable,
-		headers:  headerTable,
-		bodies:   bodiesTable,
+// CanonicalHash returns the hash of the canonical block 'num'
+func (a *AncientStore) CanonicalHash(num uint64) (hash, error) {
+	if a.hashes == nil {
+		header, err := a.GetHeaderByNumber(num)
+		if err != nil {
+			return hash{}, err
+		}
+		return header.Hash, nil
 	}
-	return store, nil
+	buf, end, err := a.hashes.get(num)
+	if err != nil {
+		return hash{}, err
+	}
+	return a.hashes.decodeHash(num, end.FileNum, buf)
 }
 
-func (a *AncientStore) LastNum() uint64 {
-	return a.headers.numItems
+// TotalDifficulty returns the total difficulty of the chain up to the
+// block 'num'. It is nil if the freezer does not store it.
+func (a *AncientStore) TotalDifficulty(num uint64) (*big.Int, error) {
+	if a.diffs == nil {
+		return nil, nil
+	}
+	td := new(big.Int)
+	if err := a.diffs.GetObj(num, (*totalDifficulty)(td)); err != nil {
+		return nil, err
+	}
+	return td, nil
 }
 
-func (a *AncientStore) Iterator() Iterator {
+func (a *AncientStore) GetHeaderByNumber(num uint64) (*Header, error) {
+	header := &Header{}
+	if err := a.headers.GetObj(num, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func (a *AncientStore) Iterator(opts ...IteratorOption) Iterator {
+	config := newIteratorConfig(opts...)
+
+	// the tables of the parts not selected are not read
 	iter := &ancientIterator{
-		rIter: a.receipts.Iter(),
-		hIter: a.headers.Iter(),
-		bIter: a.bodies.Iter(),
+		config: config,
+	}
+	if a.hashes != nil {
+		iter.hashIter = a.hashes.Iter()
+	}
+	if config.has(blockReceipts) {
+		iter.rIter = a.receipts.Iter()
+	}
+	if config.has(blockHeaders) || a.hashes == nil {
+		// the hash is computed from the header if the hashes are not stored
+		iter.hIter = a.headers.Iter()
+	}
+	if config.has(blockBodies) {
+		iter.bIter = a.bodies.Iter()
 	}
+	if a.diffs != nil && config.has(blockTotalDifficulty) {
+		iter.tdIter = a.diffs.Iter()
+	}
+
+	// the tables might have a different tail
+	iter.Seek(a.FirstNum())
 	return iter
 }
 
 type ancientIterator struct {
-	rIter *ancientTableIterator
-	hIter *ancientTableIterator
-	bIter *ancientTableIterator
+	config *iteratorConfig
+
+	// the iterators of the parts not selected and of the
+	// tables not stored are nil
+	rIter    *ancientTableIterator
+	hIter    *ancientTableIterator
+	bIter    *ancientTableIterator
+	hashIter *ancientTableIterator
+	tdIter   *ancientTableIterator
+
+	keccak *fastrlp.Keccak
+
+	// raw is the view of the current block, reused for all the blocks
+	raw *RawBlock
+}
+
+// num returns the number of the current block
+func (i *ancientIterator) num() uint64 {
+	return i.iters()[0].num - 1
+}
+
+// iters returns the iterators of all the tables read
+func (i *ancientIterator) iters() []*ancientTableIterator {
+	iters := []*ancientTableIterator{}
+	for _, iter := range []*ancientTableIterator{i.rIter, i.hIter, i.bIter, i.hashIter, i.tdIter} {
+		if iter != nil {
+			iters = append(iters, iter)
+		}
+	}
+	return iters
 }
 
 func (i *ancientIterator) Seek(num uint64) {
-	i.rIter.Seek(num)
-	i.hIter.Seek(num)
-	i.bIter.Seek(num)
+	for _, iter := range i.iters() {
+		iter.Seek(num)
+	}
 }
 
 func (i *ancientIterator) Next() bool {
-	next := i.rIter.Next()
-	i.hIter.Next()
-	i.bIter.Next()
-
+	// move all the tables even if one of them fails to keep them aligned
+	next := true
+	for _, iter := range i.iters() {
+		if !iter.Next() {
+			next = false
+		}
+	}
 	return next
 }
 
+func (i *ancientIterator) Err() error {
+	for _, iter := range i.iters() {
+		if iter.err != nil {
+			return iter.err
+		}
+	}
+	return nil
+}
+
+func (i *ancientIterator) Close() error {
+	for _, iter := range i.iters() {
+		iter.Close()
+	}
+	return nil
+}
+
 func (i *ancientIterator) Value() (*Block, error) {
-	receipts := Receipts{}
-	if err := i.rIter.Value(&receipts); err != nil {
-		return nil, err
+	var receipts *Receipts
+	if i.rIter != nil {
+		receipts = &Receipts{}
+		if err := i.rIter.Value(receipts); err != nil {
+			return nil, err
+		}
 	}
-	header := Header{}
-	if err := i.hIter.Value(&header); err != nil {
-		return nil, err
+	var header *Header
+	if i.hIter != nil {
+		header = &Header{}
+		if err := i.hIter.Value(header); err != nil {
+			return nil, err
+		}
 	}
-	body := Body{}
-	if err := i.bIter.Value(&body); err != nil {
+	var body *Body
+	if i.bIter != nil {
+		body = &Body{}
+		if err := i.bIter.Value(body); err != nil {
+			return nil, err
+		}
+	}
+	block, err := newBlock(i.num(), header, body, receipts)
+	if err != nil {
 		return nil, err
 	}
-	if len(body.Transactions) != len(receipts) {
-		return nil, fmt.Errorf("incorrect match")
+
+	if i.hashIter != nil {
+		if block.Hash, err = i.hashIter.hash(); err != nil {
+			return nil, err
+		}
+	} else {
+		block.Hash = header.Hash
 	}
+	if i.tdIter != nil {
+		td := new(big.Int)
+		if err := i.tdIter.Value((*totalDifficulty)(td)); err != nil {
+			return nil, err
+		}
+		block.TotalDifficulty = td
+	}
+
+	if err := i.config.apply(block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
 
+// newBlock creates the block 'num' with the parts that were read, the
+// others are nil
+func newBlock(num uint64, header *Header, body *Body, receipts *Receipts) (*Block, error) {
 	block := &Block{
-		Number:   header.Number,
-		Header:   &header,
-		Body:     &body,
-		Receipts: receipts,
+		Number: num,
+		Header: header,
+		Body:   body,
+	}
+	if receipts == nil {
+		return block, nil
+	}
+	block.Receipts = *receipts
+
+	if body != nil {
+		if len(body.Transactions) != len(block.Receipts) {
+			return nil, fmt.Errorf("incorrect match")
+		}
+		for indx, receipt := range block.Receipts {
+			// the type is not stored with the receipt
+			receipt.Type = body.Transactions[indx].Type
+		}
 	}
 	return block, nil
 }
 
+func (i *ancientIterator) Raw() (*RawBlock, error) {
+	var err error
+	var parts [3][]byte
+	for indx, iter := range []*ancientTableIterator{i.hIter, i.bIter, i.rIter} {
+		if iter == nil {
+			continue
+		}
+		if parts[indx], err = iter.Raw(); err != nil {
+			return nil, err
+		}
+	}
+
+	var h hash
+	if i.hashIter != nil {
+		if h, err = i.hashIter.hash(); err != nil {
+			return nil, err
+		}
+	} else {
+		if i.keccak == nil {
+			i.keccak = fastrlp.NewKeccak256()
+		}
+		i.keccak.Reset()
+		i.keccak.Write(parts[0])
+		i.keccak.Sum(h[:0])
+	}
+
+	if i.raw == nil {
+		i.raw = &RawBlock{}
+	}
+	i.raw.reset(i.num(), h, parts[0], parts[1], parts[2])
+	return i.raw, nil
+}
+
 type ancientTable struct {
 	path       string
 	name       string
 	compressed bool
 
+	// mmap is set if the files are memory mapped
+	mmap bool
+
 	// store the file of index and offsets
-	index *os.File
+	index *ancientFile
 
 	// data files
-	data map[uint16]*os.File
+	data map[uint16]*ancientFile
 
-	// number of items in the table
+	// number of items in the table, including the ones deleted from the tail
 	numItems uint64
+
+	// itemOffset is the number of items deleted from the tail of the table,
+	// the first index entry refers to this item
+	itemOffset uint64
+
+	// itemHidden is the first visible item. Items between itemOffset and
+	// itemHidden are still in the data files but they are marked as deleted
+	// in the metadata file.
+	itemHidden uint64
 }
 
-func newAncientTable(path, name string) (*ancientTable, error) {
+func (a *ancientTable) Close() error {
+	err := a.index.Close()
+	for _, f := range a.data {
+		if fErr := f.Close(); fErr != nil && err == nil {
+			err = fErr
+		}
+	}
+	return err
+}
+
+func newAncientTable(path, name string, mmap bool) (*ancientTable, error) {
 	t := &ancientTable{
 		path: path,
 		name: name,
-		data: map[uint16]*os.File{},
+		mmap: mmap,
+		data: map[uint16]*ancientFile{},
 	}
 	err := t.checkIndex()
 	if err != nil {
@@ -133,35 +571,224 @@ func newAncientTable(path, name string) (*ancientTable, error) {
 	}
 
 	// open index file
-	if t.index, err = os.Open(t.getIndexName(t.compressed)); err != nil {
+	if t.index, err = openAncientFile(t.getIndexName(t.compressed), mmap); err != nil {
 		return nil, err
 	}
-
-	stat, err := t.index.Stat()
-	if err != nil {
+	if err := t.load(); err != nil {
+		t.Close()
 		return nil, err
 	}
+	return t, nil
+}
 
-	t.numItems = uint64(stat.Size() / indexEntrySize)
+// load reads the number of items and the tail of the table from the
+// index and metadata files and opens the data files
+func (a *ancientTable) load() error {
+	if a.index.size < indexEntrySize {
+		return &AncientError{Table: a.name, File: a.index.Name(), Err: ErrTruncatedIndex}
+	}
+
+	// the first index entry marks the first data file and the number of items
+	// deleted from the tail, each item is delimited by its own entry and the
+	// previous one
+	buf := make([]byte, indexEntrySize)
+	if err := a.index.readAt(buf, 0); err != nil {
+		return err
+	}
+	var firstEntry indexEntry
+	firstEntry.Unmarshal(buf)
+
+	a.itemOffset = uint64(firstEntry.Offset)
+	a.numItems = a.itemOffset + uint64(a.index.size/indexEntrySize) - 1
+
+	// the metadata file stores the virtual tail of the table
+	virtualTail, err := a.readMetadata()
+	if err != nil {
+		return err
+	}
+	a.itemHidden = a.itemOffset
+	if virtualTail > a.itemHidden {
+		a.itemHidden = virtualTail
+	}
+	if a.itemHidden > a.numItems {
+		a.itemHidden = a.numItems
+	}
 
 	// preopen all the data files
-	if err := t.openDataFiles(); err != nil {
-		return nil, err
+	if err := a.openDataFiles(); err != nil {
+		return err
 	}
-	return t, nil
+	return nil
+}
+
+// readMetadata returns the virtual tail stored in the metadata file of
+// the table, or zero if there is no metadata file.
+func (a *ancientTable) readMetadata() (uint64, error) {
+	name := filepath.Join(a.path, a.name+".meta")
+
+	buf, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(buf) == 0) {
+		// older versions of geth do not write the metadata file
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// [version, virtual tail, (flush offset)]
+	var virtualTail uint64
+	err = unmarshalRlp(func(p *fastrlp.Parser, v *fastrlp.Value) error {
+		elems, err := v.GetElems()
+		if err != nil {
+			return err
+		}
+		if len(elems) < 2 {
+			return fmt.Errorf("expected at least 2 elements but found %d", len(elems))
+		}
+		virtualTail, err = elems[1].GetUint64()
+		return err
+	}, buf)
+	if err != nil {
+		return 0, &AncientError{Table: a.name, File: name, Err: fmt.Errorf("%w: failed to decode metadata: %v", ErrCorruptData, err)}
+	}
+	return virtualTail, nil
+}
+
+// FirstNum returns the first item that can be read from the table
+func (a *ancientTable) FirstNum() uint64 {
+	return a.itemHidden
+}
+
+// checkBounds returns an error if the item 'num' is not in the table
+func (a *ancientTable) checkBounds(num uint64) error {
+	if num < a.itemHidden {
+		return a.newError(num, a.index.Name(), ErrOutOfBounds, fmt.Errorf("item was deleted, the first item is %d", a.itemHidden))
+	}
+	if num >= a.numItems {
+		return a.newError(num, a.index.Name(), ErrOutOfBounds, fmt.Errorf("table has %d items", a.numItems))
+	}
+	return nil
+}
+
+// indexPos returns the position in the index file of the entry
+// that marks the start of the item 'num'
+func (a *ancientTable) indexPos(num uint64) int64 {
+	return int64(num-a.itemOffset) * indexEntrySize
+}
+
+// startEntry fixes the entry that marks the start of the item 'num'. The
+// first index entry stores the deleted items instead of an offset.
+func (a *ancientTable) startEntry(num uint64, entry indexEntry) indexEntry {
+	if num == a.itemOffset {
+		entry.Offset = 0
+	}
+	return entry
+}
+
+func (a *ancientTable) readTable(num uint64, fileNum uint16, from uint32, size uint32) ([]byte, error) {
+	file := a.getDataName(fileNum, a.compressed)
+
+	f, ok := a.data[fileNum]
+	if !ok {
+		return nil, a.newError(num, file, ErrCorruptData, fmt.Errorf("data file not found"))
+	}
+
+	// with mmap, the raw items are not copied and the compressed
+	// ones are decoded directly from the mapping
+	buf, err := f.slice(int64(from), int64(size))
+	if err != nil {
+		return nil, a.newError(num, file, ErrCorruptData, err)
+	}
+	if !a.compressed {
+		return buf, nil
+	}
+
+	buf, err = snappy.Decode(nil, buf)
+	if err != nil {
+		return nil, a.newError(num, file, ErrCorruptData, err)
+	}
+	return buf, nil
+}
+
+func (a *ancientTable) newError(num uint64, file string, err error, cause error) error {
+	if cause != nil {
+		err = fmt.Errorf("%w: %v", err, cause)
+	}
+	return &AncientError{Table: a.name, Item: num, File: file, Err: err}
+}
+
+// Get returns the raw (decompressed) item 'num' without moving any iterator
+func (a *ancientTable) Get(num uint64) ([]byte, error) {
+	buf, _, err := a.get(num)
+	return buf, err
+}
+
+// GetObj decodes the item 'num' into obj
+func (a *ancientTable) GetObj(num uint64, obj rlpObj) error {
+	buf, end, err := a.get(num)
+	if err != nil {
+		return err
+	}
+	if err := obj.UnmarshalRLP(buf); err != nil {
+		return a.newError(num, a.getDataName(end.FileNum, a.compressed), ErrCorruptData, err)
+	}
+	return nil
 }
 
-func (a *ancientTable) readTable(fileNum uint16, from uint32, size uint32) []byte {
-	buf := make([]byte, size)
-	_, err := a.data[fileNum].ReadAt(buf, int64(from))
+func (a *ancientTable) get(num uint64) ([]byte, indexEntry, error) {
+	if err := a.checkBounds(num); err != nil {
+		return nil, indexEntry{}, err
+	}
+
+	// read the index entries that delimit the item in a single call
+	buf, err := a.index.slice(a.indexPos(num), 2*indexEntrySize)
 	if err != nil {
-		panic(err)
+		return nil, indexEntry{}, a.newError(num, a.index.Name(), ErrTruncatedIndex, err)
 	}
+	var start, end indexEntry
+	start.Unmarshal(buf[:indexEntrySize])
+	end.Unmarshal(buf[indexEntrySize:])
 
-	if buf, err = snappy.Decode(nil, buf); err != nil {
-		panic(err)
+	start = a.startEntry(num, start)
+
+	item, err := a.readItem(num, start, end)
+	return item, end, err
+}
+
+// readItem reads the item 'num' delimited by the index entries start and end
+func (a *ancientTable) readItem(num uint64, start, end indexEntry) ([]byte, error) {
+	if start.FileNum != end.FileNum {
+		// the item is at the beginning of the next file
+		start = indexEntry{FileNum: end.FileNum}
+	}
+	if end.Offset < start.Offset {
+		return nil, a.newError(num, a.index.Name(), ErrCorruptData, fmt.Errorf("end offset %d before start offset %d", end.Offset, start.Offset))
+	}
+	return a.readTable(num, end.FileNum, start.Offset, end.Offset-start.Offset)
+}
+
+// decodeHash decodes an item of the hashes table stored in the data file 'fileNum'
+func (a *ancientTable) decodeHash(num uint64, fileNum uint16, buf []byte) (hash, error) {
+	var h hash
+	if len(buf) != len(h) {
+		return h, a.newError(num, a.getDataName(fileNum, a.compressed), ErrCorruptData, fmt.Errorf("incorrect hash length: %d", len(buf)))
 	}
-	return buf
+	copy(h[:], buf)
+	return h, nil
+}
+
+func hasAncientTable(path, name string) (bool, error) {
+	t := &ancientTable{path: path, name: name}
+	for _, compressed := range []bool{true, false} {
+		found, err := exists(t.getIndexName(compressed))
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (a *ancientTable) checkIndex() error {
@@ -174,7 +801,7 @@ func (a *ancientTable) checkIndex() error {
 		return err
 	}
 	if !hasCompr && !hasNormal {
-		return fmt.Errorf("table not found")
+		return fmt.Errorf("table %s not found", a.name)
 	}
 	if hasCompr && hasNormal {
 		return fmt.Errorf("both compress and uncompress index found")
@@ -204,16 +831,11 @@ func (a *ancientTable) getIndexName(compressed bool) string {
 }
 
 func (a *ancientTable) openDataFiles() error {
-	stat, err := a.index.Stat()
-	if err != nil {
-		return err
-	}
-
 	var firstEntry, lastEntry indexEntry
 	buf := make([]byte, indexEntrySize)
 
 	readAt := func(entry *indexEntry, pos int64) error {
-		if _, err := a.index.ReadAt(buf, pos); err != nil {
+		if err := a.index.readAt(buf, pos); err != nil {
 			return err
 		}
 		entry.Unmarshal(buf)
@@ -224,14 +846,14 @@ func (a *ancientTable) openDataFiles() error {
 	if err := readAt(&firstEntry, 0); err != nil {
 		return err
 	}
-	// read last entry
-	if err := readAt(&lastEntry, stat.Size()-indexEntrySize); err != nil {
+	// read last entry, skipping any partial entry being written
+	if err := readAt(&lastEntry, (a.index.size/indexEntrySize-1)*indexEntrySize); err != nil {
 		return err
 	}
 
 	// open the files
 	for i := firstEntry.FileNum; i <= lastEntry.FileNum; i++ {
-		f, err := os.Open(a.getDataName(i, a.compressed))
+		f, err := openAncientFile(a.getDataName(i, a.compressed), a.mmap)
 		if err != nil {
 			return err
 		}
@@ -240,62 +862,124 @@ func (a *ancientTable) openDataFiles() error {
 	return nil
 }
 
+// Iter returns an iterator over the items of the table. The iterators only
+// use positional reads, any number of them can be used concurrently.
 func (a *ancientTable) Iter() *ancientTableIterator {
 	i := &ancientTableIterator{
-		table:     a,
-		indexFile: a.index,
+		table: a,
+		buf:   make([]byte, indexEntrySize),
 	}
-	i.Seek(0)
+	i.Seek(a.itemHidden)
 	return i
 }
 
 type ancientTableIterator struct {
-	table     *ancientTable
-	indexFile *os.File
-	ptr       indexEntry
-	val       []byte
-}
+	table *ancientTable
 
-func (i *ancientTableIterator) readEntry() indexEntry {
-	buf := make([]byte, indexEntrySize)
+	// pos is the position in the index file of the next entry to read
+	pos int64
+	buf []byte
 
-	if _, err := i.indexFile.Read(buf); err != nil {
-		panic(err)
+	// num is the next item to read
+	num uint64
+	ptr indexEntry
+	val []byte
+
+	// err is the error reading the index, it stops the iteration
+	err error
+	// valErr is the error reading the current item
+	valErr error
+}
+
+func (i *ancientTableIterator) readEntry() (indexEntry, error) {
+	if err := i.table.index.readAt(i.buf, i.pos); err != nil {
+		return indexEntry{}, i.table.newError(i.num, i.table.index.Name(), ErrTruncatedIndex, err)
 	}
+	i.pos += indexEntrySize
 
 	var entry indexEntry
-	entry.Unmarshal(buf)
+	entry.Unmarshal(i.buf)
 
-	return entry
+	return entry, nil
 }
 
 func (i *ancientTableIterator) Seek(num uint64) {
-	i.indexFile.Seek(int64(num)*indexEntrySize, 0)
-	i.ptr = i.readEntry()
+	i.num = num
+	i.val, i.err, i.valErr = nil, nil, nil
+
+	if num != i.table.numItems {
+		// seeking to the end of the table is valid
+		if i.err = i.table.checkBounds(num); i.err != nil {
+			return
+		}
+	}
+	i.pos = i.table.indexPos(num)
+	if i.ptr, i.err = i.readEntry(); i.err != nil {
+		return
+	}
+	i.ptr = i.table.startEntry(num, i.ptr)
 }
 
 func (i *ancientTableIterator) Next() bool {
-	// read next entry
-	next := i.readEntry()
+	if i.err != nil || i.num >= i.table.numItems {
+		return false
+	}
 
-	if i.ptr.FileNum != next.FileNum {
-		// start from the next item
-		i.val = i.table.readTable(next.FileNum, 0, next.Offset)
-	} else {
-		// follow the sequence
-		i.val = i.table.readTable(i.ptr.FileNum, i.ptr.Offset, next.Offset-i.ptr.Offset)
+	// read next entry
+	next, err := i.readEntry()
+	if err != nil {
+		i.err = err
+		return false
 	}
 
+	// a corrupt item does not stop the iteration, the error
+	// is returned by Value
+	i.val, i.valErr = i.table.readItem(i.num, i.ptr, next)
+
 	i.ptr = next
+	i.num++
 	return true
 }
 
+// Close releases the last item read, the index file is owned by the table
+func (i *ancientTableIterator) Close() {
+	i.val = nil
+	i.valErr = nil
+}
+
 type rlpObj interface {
 	UnmarshalRLP(v []byte) error
 }
 
+// Raw returns the raw value of the current item
+func (i *ancientTableIterator) Raw() ([]byte, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	if i.valErr != nil {
+		return nil, i.valErr
+	}
+	return i.val, nil
+}
+
+// hash decodes the current item of a hashes table
+func (i *ancientTableIterator) hash() (hash, error) {
+	val, err := i.Raw()
+	if err != nil {
+		return hash{}, err
+	}
+	return i.table.decodeHash(i.num-1, i.ptr.FileNum, val)
+}
+
 func (i *ancientTableIterator) Value(obj rlpObj) error {
-	return obj.UnmarshalRLP(i.val)
+	val, err := i.Raw()
+	if err != nil {
+		return err
+	}
+	if err := obj.UnmarshalRLP(val); err != nil {
+		return i.table.newError(i.num-1, i.table.getDataName(i.ptr.FileNum, i.table.compressed), ErrCorruptData, err)
+	}
+	return nil
 }
 
 const indexEntrySize = int64(6)
@@ -0,0 +1,655 @@
+package gethdatalayer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/umbracle/fastrlp"
+)
+
+// writeAncientTable writes a freezer table with the given items in a single data file
+func writeAncientTable(t *testing.T, path, name string, items [][]byte, compressed bool) {
+	t.Helper()
+	writeAncientTableWithTail(t, path, name, items, compressed, 0, 0)
+}
+
+// writeAncientTableWithTail writes a freezer table whose first 'tail' items
+// were deleted. The remaining items are written in the data file 'fileNum'.
+func writeAncientTableWithTail(t *testing.T, path, name string, items [][]byte, compressed bool, tail uint64, fileNum uint16) {
+	t.Helper()
+
+	index := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint16(index[:2], fileNum)
+	binary.BigEndian.PutUint32(index[2:], uint32(tail))
+
+	data := []byte{}
+	for _, item := range items {
+		if compressed {
+			item = snappy.Encode(nil, item)
+		}
+		data = append(data, item...)
+
+		entry := make([]byte, indexEntrySize)
+		binary.BigEndian.PutUint16(entry[:2], fileNum)
+		binary.BigEndian.PutUint32(entry[2:], uint32(len(data)))
+		index = append(index, entry...)
+	}
+
+	table := &ancientTable{path: path, name: name}
+	if err := os.WriteFile(table.getIndexName(compressed), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(table.getDataName(fileNum, compressed), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mockHeaderRLP(num uint64, extra ...*fastrlp.Value) []byte {
+	a := &fastrlp.Arena{}
+	v := a.NewArray()
+	v.Set(a.NewCopyBytes(make([]byte, 32))) // parentHash
+	v.Set(a.NewCopyBytes(make([]byte, 32))) // sha3uncles
+	v.Set(a.NewCopyBytes(make([]byte, 20))) // miner
+	v.Set(a.NewCopyBytes(make([]byte, 32))) // stateroot
+	v.Set(a.NewCopyBytes(make([]byte, 32))) // txroot
+	v.Set(a.NewCopyBytes(make([]byte, 32))) // receiptroot
+	v.Set(a.NewCopyBytes(make([]byte, 256)))
+	v.Set(a.NewUint(1))   // difficulty
+	v.Set(a.NewUint(num)) // number
+	v.Set(a.NewUint(30_000_000))
+	v.Set(a.NewUint(0))
+	v.Set(a.NewUint(1_600_000_000 + num))
+	v.Set(a.NewCopyBytes([]byte{}))         // extraData
+	v.Set(a.NewCopyBytes(make([]byte, 32))) // mixHash
+	v.Set(a.NewCopyBytes(make([]byte, 8)))  // nonce
+	for _, elem := range extra {
+		v.Set(elem)
+	}
+	return v.MarshalTo(nil)
+}
+
+func mockEmptyListRLP(num int) []byte {
+	a := &fastrlp.Arena{}
+	v := a.NewArray()
+	for i := 0; i < num; i++ {
+		v.Set(a.NewArray())
+	}
+	return v.MarshalTo(nil)
+}
+
+func newMockAncientStore(t *testing.T, numBlocks uint64) string {
+	t.Helper()
+
+	path := t.TempDir()
+	writeMockAncientStore(t, path, numBlocks)
+	return path
+}
+
+// writeMockAncientStore writes the tables of a freezer with 'numBlocks' empty blocks
+func writeMockAncientStore(t *testing.T, path string, numBlocks uint64) {
+	t.Helper()
+
+	var headers, bodies, receipts, hashes, diffs [][]byte
+	for i := uint64(0); i < numBlocks; i++ {
+		header := mockHeaderRLP(i)
+
+		keccak := fastrlp.NewKeccak256()
+		keccak.Write(header)
+
+		a := &fastrlp.Arena{}
+
+		headers = append(headers, header)
+		bodies = append(bodies, mockEmptyListRLP(2))
+		receipts = append(receipts, mockEmptyListRLP(0))
+		hashes = append(hashes, keccak.Sum(nil))
+		diffs = append(diffs, a.NewUint(i+1).MarshalTo(nil))
+	}
+	writeAncientTable(t, path, "headers", headers, true)
+	writeAncientTable(t, path, "bodies", bodies, true)
+	writeAncientTable(t, path, "receipts", receipts, true)
+	writeAncientTable(t, path, "hashes", hashes, false)
+	writeAncientTable(t, path, "diffs", diffs, false)
+}
+
+func TestAncientStore_GetBlockByNumber(t *testing.T) {
+	store, err := NewAncientStore(newMockAncientStore(t, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num := store.LastNum(); num != 10 {
+		t.Fatalf("expected 10 items but found %d", num)
+	}
+
+	for _, num := range []uint64{7, 0, 9, 3} {
+		block, err := store.GetBlockByNumber(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Number != num {
+			t.Fatalf("expected block %d but found %d", num, block.Number)
+		}
+		if block.Hash != block.Header.Hash {
+			t.Fatal("bad block hash")
+		}
+		if block.TotalDifficulty.Uint64() != num+1 {
+			t.Fatal("bad total difficulty")
+		}
+	}
+
+	if _, err := store.GetBlockByNumber(10); err == nil {
+		t.Fatal("expected out of bounds error")
+	}
+}
+
+func TestAncientStore_Errors(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	store, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// iterating to the end does not fail
+	iter := store.Iterator()
+	count := 0
+	for iter.Next() {
+		if _, err := iter.Value(); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 10 {
+		t.Fatalf("expected 10 blocks but found %d", count)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the last body in the data file
+	bodies := filepath.Join(path, "bodies.0000.cdat")
+	stat, err := os.Stat(bodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(bodies, stat.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.GetBlockByNumber(9)
+	if !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("expected corrupt data error but found %v", err)
+	}
+	var ancientErr *AncientError
+	if !errors.As(err, &ancientErr) {
+		t.Fatal("expected an ancient error")
+	}
+	if ancientErr.Table != "bodies" || ancientErr.Item != 9 || ancientErr.File != bodies {
+		t.Fatalf("bad ancient error %v", ancientErr)
+	}
+
+	// the iterator can skip the corrupt item
+	iter = store.Iterator()
+	iter.Seek(8)
+	if !iter.Next() {
+		t.Fatal("expected block 8")
+	}
+	if _, err := iter.Value(); err != nil {
+		t.Fatal(err)
+	}
+	if !iter.Next() {
+		t.Fatal("expected block 9")
+	}
+	if _, err := iter.Value(); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("expected corrupt data error but found %v", err)
+	}
+
+	if _, err := store.GetBlockByNumber(10); !errors.Is(err, ErrOutOfBounds) {
+		t.Fatalf("expected out of bounds error but found %v", err)
+	}
+}
+
+func TestAncientStore_IteratorErr(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	store, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// truncate the index in the middle of the last entry
+	index := filepath.Join(path, "headers.cidx")
+	if err := os.Truncate(index, 10*indexEntrySize+3); err != nil {
+		t.Fatal(err)
+	}
+
+	iter := store.Iterator()
+	defer iter.Close()
+
+	count := 0
+	for iter.Next() {
+		count++
+	}
+	if count != 9 {
+		t.Fatalf("expected 9 blocks but found %d", count)
+	}
+	if err := iter.Err(); !errors.Is(err, ErrTruncatedIndex) {
+		t.Fatalf("expected truncated index error but found %v", err)
+	}
+}
+
+func TestAncientStore_RawTable(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	var hashes [][]byte
+	for i := 0; i < 10; i++ {
+		hashes = append(hashes, bytes.Repeat([]byte{byte(i)}, 32))
+	}
+	writeAncientTable(t, path, "hashes", hashes, false)
+
+	store, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	table, err := store.Table("hashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Compressed() {
+		t.Fatal("hashes table should not be compressed")
+	}
+	if num := table.NumItems(); num != 10 {
+		t.Fatalf("expected 10 items but found %d", num)
+	}
+	for _, num := range []uint64{0, 5, 9} {
+		item, err := table.Get(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(item, hashes[num]) {
+			t.Fatalf("bad item %d", num)
+		}
+	}
+
+	if _, err := store.Table("unknown"); err == nil {
+		t.Fatal("expected table not found error")
+	}
+}
+
+func TestAncientStore_Hashes(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	// the hashes table is optional
+	table := &ancientTable{path: path, name: "hashes"}
+	if err := os.Remove(table.getIndexName(false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(table.getDataName(0, false)); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	header, err := store.GetHeaderByNumber(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := store.CanonicalHash(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != header.Hash {
+		t.Fatal("bad canonical hash")
+	}
+
+	// the hash is computed from the header even if it is not selected
+	iter := store.Iterator(WithReceipts(), WithTotalDifficulty())
+	defer iter.Close()
+
+	iter.Seek(5)
+	if !iter.Next() {
+		t.Fatal(iter.Err())
+	}
+	block, err := iter.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Number != 5 || block.Hash != header.Hash || block.TotalDifficulty.Uint64() != 6 {
+		t.Fatal("bad block")
+	}
+	raw, err := iter.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Number != 5 || raw.Hash != header.Hash {
+		t.Fatal("bad raw block")
+	}
+}
+
+func TestAncientStore_CorruptDiffs(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	// the total difficulty is a list instead of an integer
+	var diffs [][]byte
+	for i := 0; i < 10; i++ {
+		diffs = append(diffs, mockEmptyListRLP(0))
+	}
+	writeAncientTable(t, path, "diffs", diffs, false)
+
+	store, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	checkErr := func(err error) {
+		t.Helper()
+
+		var ancientErr *AncientError
+		if !errors.As(err, &ancientErr) || !errors.Is(err, ErrCorruptData) {
+			t.Fatalf("expected corrupt data error but found %v", err)
+		}
+		if ancientErr.Table != "diffs" || ancientErr.Item != 3 || filepath.Base(ancientErr.File) != "diffs.0000.rdat" {
+			t.Fatalf("bad error %v", err)
+		}
+	}
+
+	_, err = store.TotalDifficulty(3)
+	checkErr(err)
+
+	iter := store.Iterator()
+	defer iter.Close()
+
+	iter.Seek(3)
+	if !iter.Next() {
+		t.Fatal(iter.Err())
+	}
+	_, err = iter.Value()
+	checkErr(err)
+}
+
+func TestAncientStore_Pruned(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	// delete the first 4 bodies and receipts and move the
+	// remaining items to a new data file
+	for _, name := range []string{"bodies", "receipts"} {
+		if err := os.Remove(filepath.Join(path, name+".0000.cdat")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var bodies, receipts [][]byte
+	for i := 4; i < 10; i++ {
+		bodies = append(bodies, mockEmptyListRLP(2))
+		receipts = append(receipts, mockEmptyListRLP(0))
+	}
+	writeAncientTableWithTail(t, path, "bodies", bodies, true, 4, 1)
+	writeAncientTableWithTail(t, path, "receipts", receipts, true, 4, 1)
+
+	// the receipt 4 is still in the data file but it is marked as deleted
+	a := &fastrlp.Arena{}
+	meta := a.NewArray()
+	meta.Set(a.NewUint(1))
+	meta.Set(a.NewUint(5))
+	if err := os.WriteFile(filepath.Join(path, "receipts.meta"), meta.MarshalTo(nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if num := store.FirstNum(); num != 5 {
+		t.Fatalf("expected first block 5 but found %d", num)
+	}
+	if num := store.LastNum(); num != 10 {
+		t.Fatalf("expected 10 blocks but found %d", num)
+	}
+
+	for _, num := range []uint64{3, 4} {
+		if _, err := store.GetBlockByNumber(num); !errors.Is(err, ErrOutOfBounds) {
+			t.Fatalf("expected out of bounds error for block %d but found %v", num, err)
+		}
+	}
+	// the headers are not pruned
+	if _, err := store.GetHeaderByNumber(0); err != nil {
+		t.Fatal(err)
+	}
+
+	iter := store.Iterator()
+	defer iter.Close()
+
+	num := uint64(5)
+	for iter.Next() {
+		block, err := iter.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Number != num {
+			t.Fatalf("expected block %d but found %d", num, block.Number)
+		}
+		num++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if num != 10 {
+		t.Fatalf("expected to iterate up to block 10 but stopped at %d", num)
+	}
+
+	iter.Seek(2)
+	if iter.Next() {
+		t.Fatal("expected seek below the first block to fail")
+	}
+	if err := iter.Err(); !errors.Is(err, ErrOutOfBounds) {
+		t.Fatalf("expected out of bounds error but found %v", err)
+	}
+}
+
+func TestAncientStore_ConcurrentIterators(t *testing.T) {
+	store, err := NewAncientStore(newMockAncientStore(t, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// every worker iterates a range of 10 blocks while the others
+	// read from the same tables
+	errCh := make(chan error, 10)
+	for w := uint64(0); w < 10; w++ {
+		go func(from uint64) {
+			iter := store.Iterator()
+			defer iter.Close()
+
+			iter.Seek(from)
+			for num := from; num < from+10; num++ {
+				if !iter.Next() {
+					errCh <- fmt.Errorf("expected block %d: %v", num, iter.Err())
+					return
+				}
+				block, err := iter.Value()
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if block.Number != num {
+					errCh <- fmt.Errorf("expected block %d but found %d", num, block.Number)
+					return
+				}
+				if _, err := store.GetBlockByNumber(99 - num); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}(w * 10)
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// countOpenFiles returns the number of files opened by the process
+func countOpenFiles(t *testing.T) int {
+	t.Helper()
+
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("the open files cannot be listed")
+	}
+	return len(entries)
+}
+
+func TestAncientTable_CloseOnError(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		path := newMockAncientStore(t, 10)
+
+		// the metadata cannot be decoded after the index is opened
+		if err := os.WriteFile(filepath.Join(path, "headers.meta"), []byte{0xc1}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the last item points to a second data file that does not exist
+		index := filepath.Join(path, "bodies.cidx")
+		buf, err := os.ReadFile(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf[len(buf)-int(indexEntrySize)+1] = 0x1
+		if err := os.WriteFile(index, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the index is truncated
+		if err := os.WriteFile(filepath.Join(path, "receipts.cidx"), []byte{0x1}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		open := countOpenFiles(t)
+		for _, name := range []string{"headers", "bodies", "receipts"} {
+			if _, err := newAncientTable(path, name, mmap); err == nil {
+				t.Fatalf("expected error opening table %s", name)
+			}
+		}
+		if found := countOpenFiles(t); found != open {
+			t.Fatalf("expected %d open files but found %d", open, found)
+		}
+	}
+}
+
+func TestAncientStore_CloseOnError(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	// the bodies table has one item less
+	var bodies [][]byte
+	for i := 0; i < 9; i++ {
+		bodies = append(bodies, mockEmptyListRLP(2))
+	}
+	writeAncientTable(t, path, "bodies", bodies, true)
+
+	open := countOpenFiles(t)
+	if _, err := NewAncientStore(path); err == nil {
+		t.Fatal("expected num of items mismatch error")
+	}
+	if found := countOpenFiles(t); found != open {
+		t.Fatalf("expected %d open files but found %d", open, found)
+	}
+
+	// the snapshots open the freezer again, which fails
+	// after the block tables are opened
+	path = newMockAncientStore(t, 10)
+
+	ancientStore, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStoreFromKV(newMockMemoryStore(10, 12), ancientStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := os.WriteFile(filepath.Join(path, "diffs.ridx"), []byte{0x1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	open = countOpenFiles(t)
+	if _, err := store.Snapshot(); err == nil {
+		t.Fatal("expected truncated index error")
+	}
+	if found := countOpenFiles(t); found != open {
+		t.Fatalf("expected %d open files but found %d", open, found)
+	}
+}
+
+func TestAncientStore_Mmap(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	// truncate the last body before the files are mapped
+	bodies := filepath.Join(path, "bodies.0000.cdat")
+	stat, err := os.Stat(bodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(bodies, stat.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewAncientStore(path, WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	iter := store.Iterator()
+	defer iter.Close()
+
+	for num := uint64(0); num < 9; num++ {
+		if !iter.Next() {
+			t.Fatalf("expected block %d", num)
+		}
+		block, err := iter.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Number != num || block.Hash != block.Header.Hash {
+			t.Fatalf("bad block %d", num)
+		}
+	}
+	if _, err := store.GetBlockByNumber(9); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("expected corrupt data error but found %v", err)
+	}
+
+	// the raw items point to the mapping
+	table, err := store.Table("hashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := table.Get(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := store.GetHeaderByNumber(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(item, header.Hash[:]) {
+		t.Fatal("bad hash item")
+	}
+}
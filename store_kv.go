@@ -0,0 +1,393 @@
+package gethdatalayer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned by the key-value stores when the key does not exist
+var ErrNotFound = errors.New("not found")
+
+// KeyValueReader is a read-only key-value database with the geth schema.
+// The Store can be built on top of any implementation.
+type KeyValueReader interface {
+	// Get returns the value of the key or ErrNotFound
+	Get(key []byte) ([]byte, error)
+
+	// Has returns true if the key exists
+	Has(key []byte) (bool, error)
+
+	// NewIterator returns an iterator over the keys with the given prefix
+	// in ascending order, starting at prefix + start
+	NewIterator(prefix []byte, start []byte) KeyValueIterator
+}
+
+// KeyValueIterator iterates over the key-values of a KeyValueReader. The key
+// and value are only valid until the next call to Next.
+type KeyValueIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Err() error
+	Close() error
+}
+
+// kvStore is a key-value database with the recent part of the chain (i.e. leveldb or pebble)
+type kvStore interface {
+	KeyValueReader
+	Iterator(opts ...IteratorOption) Iterator
+	GetBlockByNumber(num uint64) (*Block, error)
+	Close() error
+}
+
+// kvSnapshotter is implemented by the key-value stores that can pin a
+// consistent view of the database
+type kvSnapshotter interface {
+	kvSnapshot() (KeyValueReader, error)
+}
+
+func newKvIterator(db KeyValueReader, opts ...IteratorOption) *kvIterator {
+	iter := &kvIterator{
+		db:     db,
+		config: newIteratorConfig(opts...),
+	}
+	iter.Seek(0)
+	return iter
+}
+
+// kvIterator iterates the canonical chain of a key-value store. The parts of
+// the block are read by Next and they are only decoded on Value.
+type kvIterator struct {
+	db     KeyValueReader
+	config *iteratorConfig
+	num    uint64
+	err    error
+
+	// raw is the current block
+	raw *kvBlock
+
+	// block and blockErr are the decoded current block
+	block    *Block
+	blockErr error
+
+	// rawBlock is the view of the current block, reused for all the blocks
+	rawBlock *RawBlock
+}
+
+// kvBlock holds the raw parts of a block read from a key-value store,
+// the parts not selected are nil
+type kvBlock struct {
+	num      uint64
+	hash     []byte
+	header   []byte
+	body     []byte
+	receipts []byte
+	td       []byte
+}
+
+func decodeBlock(db KeyValueReader, num uint64) (*Block, error) {
+	return decodeBlockParts(db, num, &iteratorConfig{})
+}
+
+// decodeBlockParts decodes the parts of the canonical block 'num'
+// selected in the config
+func decodeBlockParts(db KeyValueReader, num uint64, config *iteratorConfig) (*Block, error) {
+	raw, err := readCanonicalKvBlock(db, num, config)
+	if err != nil {
+		return nil, err
+	}
+	return raw.decode()
+}
+
+// readCanonicalKvBlock reads the parts of the canonical block 'num' selected in the config
+func readCanonicalKvBlock(db KeyValueReader, num uint64, config *iteratorConfig) (*kvBlock, error) {
+	// find the canonical chain for 'num' to resolve
+	// the hash
+	hashB, err := db.Get(headerHashKey(num))
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(hashB) != 32 {
+		return nil, fmt.Errorf("incorrect hash length: %d", len(hashB))
+	}
+	return readKvBlock(db, num, hashB, config)
+}
+
+// decodeHeaderNumber resolves the number of the block 'hash' using the
+// headerNumberPrefix index. The index is kept for both canonical and side
+// chain blocks, even after they are moved to the ancient store.
+func decodeHeaderNumber(db KeyValueReader, hashB []byte) (uint64, error) {
+	numB, err := db.Get(headerNumberKey(hashB))
+	if err != nil {
+		return 0, err
+	}
+	if len(numB) != 8 {
+		return 0, fmt.Errorf("incorrect number length: %d", len(numB))
+	}
+	return unmarshalUint64(numB), nil
+}
+
+func decodeHeader(db KeyValueReader, num uint64, hashB []byte) (*Header, error) {
+	headerRaw, err := db.Get(headerKey(num, hashB))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	header := new(Header)
+	if err := header.UnmarshalRLP(headerRaw); err != nil {
+		return nil, fmt.Errorf("failed to decode header: %v", err)
+	}
+	return header, nil
+}
+
+// decodeBlockWithHash decodes the parts selected in the config of the block
+// 'num' with the given hash, which does not need to be part of the canonical chain
+func decodeBlockWithHash(db KeyValueReader, num uint64, hashB []byte, config *iteratorConfig) (*Block, error) {
+	raw, err := readKvBlock(db, num, hashB, config)
+	if err != nil {
+		return nil, err
+	}
+	return raw.decode()
+}
+
+// readKvBlock reads the parts selected in the config of the block 'num'
+// with the given hash
+func readKvBlock(db KeyValueReader, num uint64, hashB []byte, config *iteratorConfig) (*kvBlock, error) {
+	raw := &kvBlock{
+		num:  num,
+		hash: hashB,
+	}
+
+	var err error
+	if config.has(blockHeaders) {
+		if raw.header, err = db.Get(headerKey(num, hashB)); err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+	}
+	if config.has(blockBodies) {
+		if raw.body, err = db.Get(blockBodyKey(num, hashB)); err != nil {
+			return nil, fmt.Errorf("failed to read body: %w", err)
+		}
+	}
+	if config.has(blockReceipts) {
+		if raw.receipts, err = db.Get(blockReceiptsKey(num, hashB)); err != nil {
+			return nil, fmt.Errorf("failed to read receipts: %w", err)
+		}
+	}
+
+	// total difficulty, not stored by newer versions of geth
+	if config.has(blockTotalDifficulty) {
+		if raw.td, err = db.Get(headerTDKey(num, hashB)); err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("failed to read total difficulty: %w", err)
+		}
+	}
+	return raw, nil
+}
+
+// decode decodes the parts of the block that were read
+func (b *kvBlock) decode() (*Block, error) {
+	var header *Header
+	if b.header != nil {
+		header = new(Header)
+		if err := header.UnmarshalRLP(b.header); err != nil {
+			return nil, fmt.Errorf("failed to decode header: %v", err)
+		}
+	}
+
+	var body *Body
+	if b.body != nil {
+		body = new(Body)
+		if err := body.UnmarshalRLP(b.body); err != nil {
+			return nil, fmt.Errorf("failed to decode body: %v", err)
+		}
+	}
+
+	var receipts *Receipts
+	if b.receipts != nil {
+		receipts = new(Receipts)
+		if err := receipts.UnmarshalRLP(b.receipts); err != nil {
+			return nil, fmt.Errorf("failed to decode receipts: %v", err)
+		}
+	}
+
+	block, err := newBlock(b.num, header, body, receipts)
+	if err != nil {
+		return nil, err
+	}
+	copy(block.Hash[:], b.hash)
+
+	if b.td != nil {
+		if block.TotalDifficulty, err = decodeTotalDifficulty(b.td); err != nil {
+			return nil, fmt.Errorf("failed to decode total difficulty: %v", err)
+		}
+	}
+	return block, nil
+}
+
+func (l *kvIterator) Seek(num uint64) {
+	l.num = num
+	l.err = nil
+	l.reset(nil)
+}
+
+func (l *kvIterator) reset(raw *kvBlock) {
+	l.raw = raw
+	l.block, l.blockErr = nil, nil
+}
+
+func (l *kvIterator) Next() bool {
+	if l.err != nil {
+		return false
+	}
+
+	raw, err := readCanonicalKvBlock(l.db, l.num, l.config)
+	if errors.Is(err, ErrBlockNotFound) {
+		// end of the chain
+		l.reset(nil)
+		return false
+	}
+	if err != nil {
+		l.err = fmt.Errorf("failed to read block %d: %w", l.num, err)
+		l.reset(nil)
+		return false
+	}
+
+	l.reset(raw)
+	l.num++
+
+	return true
+}
+
+func (l *kvIterator) Value() (*Block, error) {
+	if l.raw == nil {
+		return nil, fmt.Errorf("no value, call Next first")
+	}
+	if l.block == nil && l.blockErr == nil {
+		// decode the block only once
+		l.block, l.blockErr = l.decode()
+	}
+	return l.block, l.blockErr
+}
+
+func (l *kvIterator) decode() (*Block, error) {
+	block, err := l.raw.decode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block %d: %w", l.raw.num, err)
+	}
+	if err := l.config.apply(block); err != nil {
+		return nil, fmt.Errorf("failed to process block %d: %w", l.raw.num, err)
+	}
+	return block, nil
+}
+
+func (l *kvIterator) Raw() (*RawBlock, error) {
+	if l.raw == nil {
+		return nil, fmt.Errorf("no value, call Next first")
+	}
+	if l.rawBlock == nil {
+		l.rawBlock = &RawBlock{}
+	}
+	var h hash
+	copy(h[:], l.raw.hash)
+
+	l.rawBlock.reset(l.raw.num, h, l.raw.header, l.raw.body, l.raw.receipts)
+	return l.rawBlock, nil
+}
+
+func (l *kvIterator) Err() error {
+	return l.err
+}
+
+func (l *kvIterator) Close() error {
+	l.reset(nil)
+	return nil
+}
+
+var (
+	// headerPrefix + num (uint64 big endian) + hash -> header
+	headerPrefix = []byte("h")
+
+	// blockBodyPrefix + num (uint64 big endian) + hash -> block body
+	blockBodyPrefix = []byte("b")
+
+	// blockReceiptsPrefix + num (uint64 big endian) + hash -> block receipts
+	blockReceiptsPrefix = []byte("r")
+
+	// headerPrefix + num (uint64 big endian) + headerHashSuffix -> hash
+	headerHashSuffix = []byte("n")
+
+	// headerPrefix + num (uint64 big endian) + hash + headerTDSuffix -> td
+	headerTDSuffix = []byte("t")
+
+	// headBlockKey tracks the latest known full block
+	headBlockKey = []byte("LastBlock")
+
+	// headHeaderKey tracks the latest known header
+	headHeaderKey = []byte("LastHeader")
+
+	// headFastBlockKey tracks the latest known incomplete block during fast sync
+	headFastBlockKey = []byte("LastFast")
+
+	// headFinalizedBlockKey tracks the latest known finalized block
+	headFinalizedBlockKey = []byte("LastFinalized")
+
+	headerNumberPrefix = []byte("H") // headerNumberPrefix + hash -> num (uint64 big endian)
+)
+
+func marshalUint64(num uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, num)
+	return buf
+}
+
+func unmarshalUint64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+func decodeKey(b []byte) (uint64, []byte) {
+	return unmarshalUint64(b[1:9]), b[9:]
+}
+
+func headerKey(number uint64, hash []byte) []byte {
+	return append(append(headerPrefix, marshalUint64(number)...), hash...)
+}
+
+func blockBodyKey(number uint64, hash []byte) []byte {
+	return append(append(blockBodyPrefix, marshalUint64(number)...), hash[:]...)
+}
+
+func blockReceiptsKey(number uint64, hash []byte) []byte {
+	return append(append(blockReceiptsPrefix, marshalUint64(number)...), hash[:]...)
+}
+
+func headerTDKey(number uint64, hash []byte) []byte {
+	return append(headerKey(number, hash), headerTDSuffix...)
+}
+
+func headerHashKey(number uint64) []byte {
+	return append(append(headerPrefix, marshalUint64(number)...), headerHashSuffix...)
+}
+
+// prefixRange returns the lower and upper bounds of the keys with
+// 'prefix' that are after prefix + start. The upper bound is nil if
+// there is no limit.
+func prefixRange(prefix, start []byte) ([]byte, []byte) {
+	lower := append(append([]byte{}, prefix...), start...)
+
+	var upper []byte
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if c := prefix[i]; c < 0xff {
+			upper = append([]byte{}, prefix[:i+1]...)
+			upper[i] = c + 1
+			break
+		}
+	}
+	return lower, upper
+}
+
+func headerNumberKey(hash []byte) []byte {
+	return append(headerNumberPrefix, hash...)
+}
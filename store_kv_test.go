@@ -0,0 +1,214 @@
+package gethdatalayer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// newMockMemoryStore returns a memory store with the empty canonical
+// blocks [from, to)
+func newMockMemoryStore(from, to uint64) *MemoryStore {
+	store := NewMemoryStore()
+	for i := from; i < to; i++ {
+		store.PutBlock(i, mockHeaderRLP(i), mockEmptyListRLP(2), mockEmptyListRLP(0))
+	}
+	return store
+}
+
+// mockKvBlock returns the key-values of an empty canonical block 'num'
+func mockKvBlock(num uint64) map[string][]byte {
+	res := map[string][]byte{}
+
+	iter := newMockMemoryStore(num, num+1).NewIterator(nil, nil)
+	for iter.Next() {
+		res[string(iter.Key())] = iter.Value()
+	}
+	return res
+}
+
+func testKvStore(t *testing.T, path string, engine string) {
+	t.Helper()
+
+	found, err := detectEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != engine {
+		t.Fatalf("expected engine %s but found %s", engine, found)
+	}
+
+	store, err := newKvStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	block, err := store.GetBlockByNumber(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Number != 1 || block.Hash != block.Header.Hash {
+		t.Fatal("bad block")
+	}
+	if _, err := store.GetBlockByNumber(2); err != ErrBlockNotFound {
+		t.Fatalf("expected block not found but found %v", err)
+	}
+
+	if ok, err := store.Has(headerHashKey(1)); err != nil || !ok {
+		t.Fatalf("expected canonical hash: %v", err)
+	}
+	if ok, err := store.Has(headerHashKey(2)); err != nil || ok {
+		t.Fatalf("unexpected canonical hash: %v", err)
+	}
+
+	iter := store.NewIterator(headerNumberPrefix, nil)
+	defer iter.Close()
+
+	count := 0
+	for iter.Next() {
+		if num := unmarshalUint64(iter.Value()); num != 1 {
+			t.Fatalf("expected number 1 but found %d", num)
+		}
+		count++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 entry but found %d", count)
+	}
+}
+
+func TestKvStore_LevelDb(t *testing.T) {
+	path := t.TempDir()
+
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range mockKvBlock(1) {
+		if err := db.Put([]byte(k), v, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testKvStore(t, path, engineLevelDb)
+}
+
+func TestKvStore_Pebble(t *testing.T) {
+	path := t.TempDir()
+
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range mockKvBlock(1) {
+		if err := db.Set([]byte(k), v, pebble.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testKvStore(t, path, enginePebble)
+}
+
+func TestKvStore_NotFound(t *testing.T) {
+	if _, err := detectEngine(t.TempDir()); err == nil {
+		t.Fatal("expected no database error")
+	}
+}
+
+func TestMemoryStore_Iterator(t *testing.T) {
+	store := newMockMemoryStore(0, 5)
+
+	// iterate the canonical hashes from block 2
+	iter := store.NewIterator(headerPrefix, marshalUint64(2))
+	defer iter.Close()
+
+	nums := []uint64{}
+	for iter.Next() {
+		if !bytes.HasSuffix(iter.Key(), headerHashSuffix) {
+			continue
+		}
+		num, _ := decodeKey(iter.Key())
+		nums = append(nums, num)
+	}
+	if len(nums) != 3 || nums[0] != 2 || nums[2] != 4 {
+		t.Fatalf("bad canonical numbers %v", nums)
+	}
+
+	store.Delete(headerHashKey(4))
+	if _, err := store.GetBlockByNumber(4); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("expected block not found but found %v", err)
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	cases := []struct {
+		prefix, start, lower, upper []byte
+	}{
+		{nil, nil, []byte{}, nil},
+		{[]byte{0x1}, []byte{0x2}, []byte{0x1, 0x2}, []byte{0x2}},
+		{[]byte{0x1, 0xff}, nil, []byte{0x1, 0xff}, []byte{0x2}},
+		{[]byte{0xff}, nil, []byte{0xff}, nil},
+	}
+	for _, c := range cases {
+		lower, upper := prefixRange(c.prefix, c.start)
+		if !bytes.Equal(lower, c.lower) || !bytes.Equal(upper, c.upper) {
+			t.Fatalf("bad range for %x: %x %x", c.prefix, lower, upper)
+		}
+	}
+}
+
+func TestLevelDbStore_Snapshot(t *testing.T) {
+	db, err := leveldb.OpenFile(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &LevelDbStore{db: db}
+	defer store.Close()
+
+	for k, v := range mockKvBlock(0) {
+		if err := db.Put([]byte(k), v, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, err := store.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// block 1 is written after the snapshot
+	for k, v := range mockKvBlock(1) {
+		if err := db.Put([]byte(k), v, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.GetBlockByNumber(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.GetBlockByNumber(1); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("expected block not found but found %v", err)
+	}
+	if _, err := snap.GetBlockByNumber(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the snapshot does not close the database
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetBlockByNumber(0); err != nil {
+		t.Fatal(err)
+	}
+}
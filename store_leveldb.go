@@ -1,15 +1,29 @@
 package gethdatalayer
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+var _ kvStore = &LevelDbStore{}
+
 type LevelDbStore struct {
 	db *leveldb.DB
+
+	// snap is set if the store is a snapshot of db
+	snap *leveldb.Snapshot
+}
+
+// levelDbReader is implemented by both the database and its snapshots
+type levelDbReader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	Has(key []byte, ro *opt.ReadOptions) (bool, error)
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
 }
 
 func NewLevelDBStore(path string) (*LevelDbStore, error) {
@@ -23,150 +37,77 @@ func NewLevelDBStore(path string) (*LevelDbStore, error) {
 	return store, nil
 }
 
-func (l *LevelDbStore) Iterator() Iterator {
-	iter := &levelDbIterator{
-		db: l,
-	}
-	iter.Seek(0)
-	return iter
+func (l *LevelDbStore) Iterator(opts ...IteratorOption) Iterator {
+	return newKvIterator(l, opts...)
 }
 
-type levelDbIterator struct {
-	db    *LevelDbStore
-	num   uint64
-	block *Block
+func (l *LevelDbStore) GetBlockByNumber(num uint64) (*Block, error) {
+	return decodeBlock(l, num)
 }
 
-type kvDb interface {
-	Get([]byte) ([]byte, error)
-}
-
-func decodeBlock(db kvDb, num uint64) (*Block, error) {
-	// find the canonical chain for 'num' to resolve
-	// the hash
-	hashB, err := db.Get(headerHashKey(num))
-	if err != nil {
-		return nil, err
-	}
-	if len(hashB) != 32 {
-		return nil, fmt.Errorf("incorrect hash length: %d", len(hashB))
-	}
-
-	// header
-	headerRaw, err := db.Get(headerKey(num, hashB))
-	if err != nil {
-		return nil, err
-	}
-	header := new(Header)
-	if err := header.UnmarshalRLP(headerRaw); err != nil {
-		return nil, fmt.Errorf("failed to decode header: %v", err)
+// Snapshot returns a view of the database at this point in time. Closing
+// the snapshot releases it but does not close the database.
+func (l *LevelDbStore) Snapshot() (*LevelDbStore, error) {
+	if l.snap != nil {
+		return nil, fmt.Errorf("store is already a snapshot")
 	}
-
-	// body
-	bodyRaw, err := db.Get(blockBodyKey(num, hashB))
+	snap, err := l.db.GetSnapshot()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to create leveldb snapshot: %v", err)
 	}
-	body := new(Body)
-	if err := body.UnmarshalRLP(bodyRaw); err != nil {
-		return nil, fmt.Errorf("failed to decode body: %v", err)
-	}
-
-	// receipts
-	receiptsRaw, err := db.Get(blockReceiptsKey(num, hashB))
-	if err != nil {
-		return nil, err
-	}
-	receipts := new(Receipts)
-	if err := receipts.UnmarshalRLP(receiptsRaw); err != nil {
-		return nil, fmt.Errorf("failed to decode receipts: %v", err)
-	}
-
-	if len(body.Transactions) != len(*receipts) {
-		return nil, fmt.Errorf("incorrect match")
-	}
-
-	resp := &Block{
-		Number:   num,
-		Header:   header,
-		Body:     body,
-		Receipts: *receipts,
+	store := &LevelDbStore{
+		db:   l.db,
+		snap: snap,
 	}
-	return resp, nil
-}
-
-func (l *LevelDbStore) Get(k []byte) ([]byte, error) {
-	return l.db.Get(k, nil)
+	return store, nil
 }
 
-func (l *levelDbIterator) Seek(num uint64) {
-	l.num = num
+func (l *LevelDbStore) kvSnapshot() (KeyValueReader, error) {
+	return l.Snapshot()
 }
 
-func (l *levelDbIterator) Next() bool {
-	block, err := decodeBlock(l.db, l.num)
-	if err != nil {
-		return false
+func (l *LevelDbStore) Close() error {
+	if l.snap != nil {
+		l.snap.Release()
+		return nil
 	}
-
-	l.block = block
-	l.num++
-
-	return true
-}
-
-func (l *levelDbIterator) Value() (*Block, error) {
-	return l.block, nil
-}
-
-var (
-	// headerPrefix + num (uint64 big endian) + hash -> header
-	headerPrefix = []byte("h")
-
-	// blockBodyPrefix + num (uint64 big endian) + hash -> block body
-	blockBodyPrefix = []byte("b")
-
-	// blockReceiptsPrefix + num (uint64 big endian) + hash -> block receipts
-	blockReceiptsPrefix = []byte("r")
-
-	// headerPrefix + num (uint64 big endian) + headerHashSuffix -> hash
-	headerHashSuffix = []byte("n")
-
-	headBlockKey = []byte("LastBlock")
-
-	headerNumberPrefix = []byte("H") // headerNumberPrefix + hash -> num (uint64 big endian)
-)
-
-func marshalUint64(num uint64) []byte {
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, num)
-	return buf
+	return l.db.Close()
 }
 
-func unmarshalUint64(b []byte) uint64 {
-	return binary.BigEndian.Uint64(b)
+func (l *LevelDbStore) reader() levelDbReader {
+	if l.snap != nil {
+		return l.snap
+	}
+	return l.db
 }
 
-func decodeKey(b []byte) (uint64, []byte) {
-	return unmarshalUint64(b[1:9]), b[9:]
+func (l *LevelDbStore) Get(k []byte) ([]byte, error) {
+	v, err := l.reader().Get(k, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	return v, err
 }
 
-func headerKey(number uint64, hash []byte) []byte {
-	return append(append(headerPrefix, marshalUint64(number)...), hash...)
+func (l *LevelDbStore) Has(k []byte) (bool, error) {
+	return l.reader().Has(k, nil)
 }
 
-func blockBodyKey(number uint64, hash []byte) []byte {
-	return append(append(blockBodyPrefix, marshalUint64(number)...), hash[:]...)
+func (l *LevelDbStore) NewIterator(prefix []byte, start []byte) KeyValueIterator {
+	lower, upper := prefixRange(prefix, start)
+	iter := l.reader().NewIterator(&util.Range{Start: lower, Limit: upper}, nil)
+	return &levelDbKvIterator{iter}
 }
 
-func blockReceiptsKey(number uint64, hash []byte) []byte {
-	return append(append(blockReceiptsPrefix, marshalUint64(number)...), hash[:]...)
+type levelDbKvIterator struct {
+	iterator.Iterator
 }
 
-func headerHashKey(number uint64) []byte {
-	return append(append(headerPrefix, marshalUint64(number)...), headerHashSuffix...)
+func (l *levelDbKvIterator) Err() error {
+	return l.Error()
 }
 
-func headerNumberKey(hash []byte) []byte {
-	return append(headerNumberPrefix, hash...)
+func (l *levelDbKvIterator) Close() error {
+	l.Release()
+	return nil
 }
@@ -0,0 +1,166 @@
+package gethdatalayer
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/umbracle/fastrlp"
+)
+
+var _ kvStore = &MemoryStore{}
+
+// MemoryStore is an in-memory key-value store with the geth schema.
+// It is useful to build synthetic chains for tests.
+type MemoryStore struct {
+	lock sync.RWMutex
+	db   map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		db: map[string][]byte{},
+	}
+}
+
+// Put sets the value of the key
+func (m *MemoryStore) Put(k []byte, v []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.db[string(k)] = append([]byte{}, v...)
+}
+
+// Delete removes the key
+func (m *MemoryStore) Delete(k []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.db, string(k))
+}
+
+// PutBlock writes the rlp encoded header, body and receipts of a block and
+// makes it part of the canonical chain. It returns the hash of the block.
+func (m *MemoryStore) PutBlock(num uint64, header, body, receipts []byte) hash {
+	keccak := fastrlp.NewKeccak256()
+	keccak.Write(header)
+
+	var h hash
+	copy(h[:], keccak.Sum(nil))
+
+	m.Put(headerKey(num, h[:]), header)
+	m.Put(blockBodyKey(num, h[:]), body)
+	m.Put(blockReceiptsKey(num, h[:]), receipts)
+	m.Put(headerHashKey(num), h[:])
+	m.Put(headerNumberKey(h[:]), marshalUint64(num))
+
+	return h
+}
+
+// Snapshot returns a copy of the store, later writes are not visible
+// to the snapshot
+func (m *MemoryStore) Snapshot() *MemoryStore {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	snap := NewMemoryStore()
+	for k, v := range m.db {
+		snap.db[k] = v
+	}
+	return snap
+}
+
+func (m *MemoryStore) kvSnapshot() (KeyValueReader, error) {
+	return m.Snapshot(), nil
+}
+
+func (m *MemoryStore) Iterator(opts ...IteratorOption) Iterator {
+	return newKvIterator(m, opts...)
+}
+
+func (m *MemoryStore) GetBlockByNumber(num uint64) (*Block, error) {
+	return decodeBlock(m, num)
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) Get(k []byte) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	v, ok := m.db[string(k)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (m *MemoryStore) Has(k []byte) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.db[string(k)]
+	return ok, nil
+}
+
+// NewIterator returns an iterator over a copy of the matching key-values,
+// later writes are not visible to the iterator
+func (m *MemoryStore) NewIterator(prefix []byte, start []byte) KeyValueIterator {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	lower, _ := prefixRange(prefix, start)
+
+	keys := []string{}
+	for k := range m.db {
+		if bytes.HasPrefix([]byte(k), prefix) && k >= string(lower) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = m.db[k]
+	}
+	return &memoryKvIterator{keys: keys, values: values, pos: -1}
+}
+
+type memoryKvIterator struct {
+	keys   []string
+	values [][]byte
+	pos    int
+}
+
+func (m *memoryKvIterator) Next() bool {
+	if m.pos >= len(m.keys) {
+		return false
+	}
+	m.pos++
+	return m.pos < len(m.keys)
+}
+
+func (m *memoryKvIterator) Key() []byte {
+	if m.pos < 0 || m.pos >= len(m.keys) {
+		return nil
+	}
+	return []byte(m.keys[m.pos])
+}
+
+func (m *memoryKvIterator) Value() []byte {
+	if m.pos < 0 || m.pos >= len(m.keys) {
+		return nil
+	}
+	return m.values[m.pos]
+}
+
+func (m *memoryKvIterator) Err() error {
+	return nil
+}
+
+func (m *memoryKvIterator) Close() error {
+	m.keys, m.values = nil, nil
+	return nil
+}
@@ -0,0 +1,146 @@
+package gethdatalayer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cockroachdb/pebble"
+)
+
+var _ kvStore = &PebbleStore{}
+
+type PebbleStore struct {
+	db *pebble.DB
+
+	// snap is set if the store is a snapshot of db
+	snap *pebble.Snapshot
+}
+
+// pebbleReader is implemented by both the database and its snapshots
+type pebbleReader interface {
+	Get(key []byte) ([]byte, io.Closer, error)
+	NewIter(o *pebble.IterOptions) (*pebble.Iterator, error)
+}
+
+func NewPebbleStore(path string) (*PebbleStore, error) {
+	db, err := pebble.Open(path, &pebble.Options{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pebble: %v", err)
+	}
+	store := &PebbleStore{
+		db: db,
+	}
+	return store, nil
+}
+
+func (p *PebbleStore) Iterator(opts ...IteratorOption) Iterator {
+	return newKvIterator(p, opts...)
+}
+
+func (p *PebbleStore) GetBlockByNumber(num uint64) (*Block, error) {
+	return decodeBlock(p, num)
+}
+
+// Snapshot returns a view of the database at this point in time. Closing
+// the snapshot releases it but does not close the database.
+func (p *PebbleStore) Snapshot() (*PebbleStore, error) {
+	if p.snap != nil {
+		return nil, fmt.Errorf("store is already a snapshot")
+	}
+	store := &PebbleStore{
+		db:   p.db,
+		snap: p.db.NewSnapshot(),
+	}
+	return store, nil
+}
+
+func (p *PebbleStore) kvSnapshot() (KeyValueReader, error) {
+	return p.Snapshot()
+}
+
+func (p *PebbleStore) Close() error {
+	if p.snap != nil {
+		return p.snap.Close()
+	}
+	return p.db.Close()
+}
+
+func (p *PebbleStore) reader() pebbleReader {
+	if p.snap != nil {
+		return p.snap
+	}
+	return p.db
+}
+
+func (p *PebbleStore) Get(k []byte) ([]byte, error) {
+	v, closer, err := p.reader().Get(k)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the value is only valid until the closer is called
+	buf := append([]byte{}, v...)
+	if err := closer.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (p *PebbleStore) Has(k []byte) (bool, error) {
+	_, closer, err := p.reader().Get(k)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, closer.Close()
+}
+
+func (p *PebbleStore) NewIterator(prefix []byte, start []byte) KeyValueIterator {
+	lower, upper := prefixRange(prefix, start)
+	iter, err := p.reader().NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	return &pebbleKvIterator{iter: iter, err: err}
+}
+
+type pebbleKvIterator struct {
+	iter  *pebble.Iterator
+	moved bool
+	err   error
+}
+
+func (p *pebbleKvIterator) Next() bool {
+	if p.err != nil {
+		return false
+	}
+	if !p.moved {
+		p.moved = true
+		return p.iter.First()
+	}
+	return p.iter.Next()
+}
+
+func (p *pebbleKvIterator) Key() []byte {
+	return p.iter.Key()
+}
+
+func (p *pebbleKvIterator) Value() []byte {
+	return p.iter.Value()
+}
+
+func (p *pebbleKvIterator) Err() error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.iter.Error()
+}
+
+func (p *pebbleKvIterator) Close() error {
+	if p.iter == nil {
+		return nil
+	}
+	return p.iter.Close()
+}
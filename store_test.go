@@ -0,0 +1,615 @@
+package gethdatalayer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/umbracle/fastrlp"
+)
+
+func TestStore_FromKV(t *testing.T) {
+	// the chain only lives in the memory store
+	store, err := NewStoreFromKV(newMockMemoryStore(0, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	block, err := store.GetBlockByNumber(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := store.GetBlockByHash(block.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Number != 3 {
+		t.Fatalf("expected block 3 but found %d", found.Number)
+	}
+
+	// without an ancient store the chain must start at the genesis
+	if _, err := NewStoreFromKV(newMockMemoryStore(11, 12), nil); err != ErrBlockNotFound {
+		t.Fatalf("expected block not found but found %v", err)
+	}
+}
+
+func TestStore_GetByHash(t *testing.T) {
+	ancientStore, err := NewAncientStore(newMockAncientStore(t, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := newMockMemoryStore(10, 15)
+
+	// geth keeps the number index of the frozen blocks in the kv store
+	for i := uint64(0); i < 10; i++ {
+		h, err := ancientStore.CanonicalHash(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kv.Put(headerNumberKey(h[:]), marshalUint64(i))
+	}
+
+	// side chain blocks below and above the ancient limit, only
+	// the number index and the parts of the block are written
+	a := &fastrlp.Arena{}
+
+	sideBlocks := map[uint64]hash{}
+	for _, num := range []uint64{5, 12} {
+		canonical, _ := kv.Get(headerHashKey(num))
+		sideBlocks[num] = kv.PutBlock(num, mockHeaderRLP(num, a.NewUint(7)), mockEmptyListRLP(2), mockEmptyListRLP(0))
+		kv.Put(headerHashKey(num), canonical)
+	}
+
+	store, err := NewStoreFromKV(kv, ancientStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	checkBlock := func(h hash, num uint64) {
+		t.Helper()
+
+		header, err := store.GetHeaderByHash(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := store.GetBlockByHash(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Number != num || header.Hash != h || block.Number != num || block.Hash != h || block.Header.Hash != h {
+			t.Fatalf("bad block %d", num)
+		}
+	}
+
+	// canonical blocks in the ancient and the kv stores
+	for _, num := range []uint64{3, 12} {
+		block, err := store.GetBlockByNumber(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkBlock(block.Hash, num)
+	}
+
+	// non canonical blocks in the kv store, the block 5 is below the
+	// ancient limit but it is not in the ancient store
+	for num, h := range sideBlocks {
+		checkBlock(h, num)
+
+		block, err := store.GetBlockByNumber(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Hash == h {
+			t.Fatalf("the side block %d should not be canonical", num)
+		}
+	}
+
+	// unknown hash
+	if _, err := store.GetHeaderByHash(hash{0x1}); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("expected block not found but found %v", err)
+	}
+	if _, err := store.GetBlockByHash(hash{0x1}); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("expected block not found but found %v", err)
+	}
+}
+
+func TestStore_Iterator(t *testing.T) {
+	ancientStore, err := NewAncientStore(newMockAncientStore(t, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStoreFromKV(newMockMemoryStore(10, 15), ancientStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	iter := store.Iterator()
+	defer iter.Close()
+
+	num := uint64(0)
+	for iter.Next() {
+		block, err := iter.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Number != num {
+			t.Fatalf("expected block %d but found %d", num, block.Number)
+		}
+		num++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if num != 15 {
+		t.Fatalf("expected 15 blocks but found %d", num)
+	}
+}
+
+func TestStore_Snapshot(t *testing.T) {
+	ancientStore, err := NewAncientStore(newMockAncientStore(t, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := newMockMemoryStore(10, 12)
+
+	store, err := NewStoreFromKV(kv, ancientStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	snap, err := store.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write block 12 and delete block 10 (as if it was frozen) after the snapshot
+	kv.PutBlock(12, mockHeaderRLP(12), mockEmptyListRLP(2), mockEmptyListRLP(0))
+	kv.Delete(headerHashKey(10))
+
+	iter := snap.Iterator()
+	num := uint64(0)
+	for iter.Next() {
+		if _, err := iter.Value(); err != nil {
+			t.Fatal(err)
+		}
+		num++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if num != 12 {
+		t.Fatalf("expected 12 blocks but found %d", num)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the snapshot does not close the ancient store of the store
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetBlockByNumber(5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_SnapshotFrozenBlocks(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	ancientStore, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := newMockMemoryStore(10, 15)
+
+	store, err := NewStoreFromKV(kv, ancientStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// freeze the blocks 10 to 12 and prune them from the key-value store
+	writeMockAncientStore(t, path, 13)
+	for i := uint64(10); i < 13; i++ {
+		kv.Delete(headerHashKey(i))
+	}
+
+	snap, err := store.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	iter := snap.Iterator()
+	defer iter.Close()
+
+	iter.Seek(8)
+	num := uint64(8)
+	for iter.Next() {
+		block, err := iter.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Number != num || block.Hash != block.Header.Hash {
+			t.Fatalf("bad block %d", num)
+		}
+		num++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if num != 15 {
+		t.Fatalf("expected to iterate up to block 15 but found %d", num)
+	}
+}
+
+func TestStore_Checkpoint(t *testing.T) {
+	for _, engine := range []string{engineLevelDb, enginePebble} {
+		t.Run(engine, func(t *testing.T) {
+			testStoreCheckpoint(t, engine)
+		})
+	}
+}
+
+func testStoreCheckpoint(t *testing.T, engine string) {
+	path := t.TempDir()
+
+	// geth appended a header that is not in the other tables yet
+	ancientPath := filepath.Join(path, "ancient", "chain")
+	if err := os.MkdirAll(ancientPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMockAncientStore(t, ancientPath, 10)
+
+	headers := [][]byte{}
+	for i := uint64(0); i < 11; i++ {
+		headers = append(headers, mockHeaderRLP(i))
+	}
+	writeAncientTable(t, ancientPath, "headers", headers, true)
+
+	// the database is open (and locked) while the store is created
+	var put func(k, v []byte) error
+	var closeDb func() error
+
+	if engine == engineLevelDb {
+		db, err := leveldb.OpenFile(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		put = func(k, v []byte) error { return db.Put(k, v, nil) }
+		closeDb = db.Close
+	} else {
+		db, err := pebble.Open(path, &pebble.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		put = func(k, v []byte) error { return db.Set(k, v, pebble.Sync) }
+		closeDb = db.Close
+	}
+	defer closeDb()
+
+	for i := uint64(10); i < 13; i++ {
+		for k, v := range mockKvBlock(i) {
+			if err := put([]byte(k), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := NewStore(path); err == nil {
+		t.Fatal("expected the database to be locked")
+	}
+
+	checkpointDir := t.TempDir()
+
+	// the freezer of a running node cannot be memory mapped
+	if _, err := NewStore(path, WithCheckpoint(checkpointDir), WithAncientOptions(WithMmap())); err == nil {
+		t.Fatal("expected mmap with checkpoint error")
+	}
+
+	store, err := NewStore(path, WithCheckpoint(checkpointDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the blocks written after the checkpoint are not visible
+	for k, v := range mockKvBlock(13) {
+		if err := put([]byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter := store.Iterator()
+	num := uint64(0)
+	for iter.Next() {
+		if _, err := iter.Value(); err != nil {
+			t.Fatal(err)
+		}
+		num++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if num != 13 {
+		t.Fatalf("expected 13 blocks but found %d", num)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the checkpoint is removed on close
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(checkpointDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the checkpoint to be removed but found %d files", len(entries))
+	}
+}
+
+func TestCheckpoint_ManifestRotation(t *testing.T) {
+	path := t.TempDir()
+
+	files := map[string]string{
+		"CURRENT":         "MANIFEST-000001\n",
+		"MANIFEST-000001": "manifest 1",
+		"000001.ldb":      "table 1",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(path, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a compaction writes a new manifest and removes the previous
+	// one after the state files are copied
+	attempts := 0
+	checkpointCopyHook = func() {
+		attempts++
+		if attempts != 1 {
+			return
+		}
+		if err := os.WriteFile(filepath.Join(path, "MANIFEST-000002"), []byte("manifest 2"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "CURRENT"), []byte("MANIFEST-000002\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(path, "MANIFEST-000001")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		checkpointCopyHook = nil
+	}()
+
+	target, err := createCheckpoint(path, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts but found %d", attempts)
+	}
+
+	current, err := os.ReadFile(filepath.Join(target, "CURRENT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "MANIFEST-000002\n" {
+		t.Fatalf("bad current file %q", current)
+	}
+	if _, err := os.Stat(filepath.Join(target, "MANIFEST-000002")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a manifest edit is also detected
+	attempts = 0
+	checkpointCopyHook = func() {
+		attempts++
+		if attempts != 1 {
+			return
+		}
+		f, err := os.OpenFile(filepath.Join(path, "MANIFEST-000002"), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write([]byte("edit")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := createCheckpoint(path, t.TempDir(), false); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts but found %d", attempts)
+	}
+}
+
+func TestCheckpoint_LinkFile(t *testing.T) {
+	dir := t.TempDir()
+
+	src, dst := filepath.Join(dir, "000001.ldb"), filepath.Join(dir, "000002.ldb")
+	if err := os.WriteFile(src, []byte{0x1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the link fails because the target exists
+	if err := os.WriteFile(dst, []byte{0x2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := linkFile(src, dst, false); err == nil || !strings.Contains(err.Error(), "WithCheckpointCopy") {
+		t.Fatalf("expected hard link error but found %v", err)
+	}
+	if err := linkFile(src, dst, true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{0x1}) {
+		t.Fatal("expected the file to be copied")
+	}
+}
+
+func TestStore_IteratorParts(t *testing.T) {
+	path := newMockAncientStore(t, 10)
+
+	// the bodies are not read if only the headers are selected
+	if err := os.Truncate(filepath.Join(path, "bodies.0000.cdat"), 0); err != nil {
+		t.Fatal(err)
+	}
+	ancientStore, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := newMockMemoryStore(10, 15)
+	for i := uint64(10); i < 15; i++ {
+		h, _ := kv.Get(headerHashKey(i))
+		kv.Put(headerTDKey(i, h), (&fastrlp.Arena{}).NewUint(i+1).MarshalTo(nil))
+	}
+
+	store, err := NewStoreFromKV(kv, ancientStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	iter := store.Iterator(WithHeaders())
+	num := uint64(0)
+	for iter.Next() {
+		block, err := iter.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Number != num || block.Header == nil || block.Hash != block.Header.Hash {
+			t.Fatalf("bad block %d", num)
+		}
+		if block.Body != nil || block.Receipts != nil || block.TotalDifficulty != nil {
+			t.Fatal("only the header should be decoded")
+		}
+		num++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if num != 15 {
+		t.Fatalf("expected 15 blocks but found %d", num)
+	}
+	iter.Close()
+
+	// the total difficulty is read from both stores if selected
+	iter = store.Iterator(WithHeaders(), WithTotalDifficulty())
+	for num = 0; iter.Next(); num++ {
+		block, err := iter.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.TotalDifficulty == nil || block.TotalDifficulty.Uint64() != num+1 {
+			t.Fatalf("bad total difficulty of block %d", num)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if num != 15 {
+		t.Fatalf("expected 15 blocks but found %d", num)
+	}
+	iter.Close()
+
+	// the bodies and receipts are read from the kv store
+	iter = store.Iterator(WithBodies(), WithReceipts())
+	defer iter.Close()
+
+	iter.Seek(10)
+	for iter.Next() {
+		block, err := iter.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Header != nil || block.Body == nil {
+			t.Fatalf("bad parts of block %d", block.Number)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_HeadMarkers(t *testing.T) {
+	kv := newMockMemoryStore(0, 10)
+
+	store, err := NewStoreFromKV(kv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// the markers are not written yet
+	if _, err := store.Head(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error but found %v", err)
+	}
+	if _, err := store.Syncing(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error but found %v", err)
+	}
+
+	markers := []struct {
+		key    []byte
+		num    uint64
+		header func() (*Header, error)
+	}{
+		{headBlockKey, 5, store.Head},
+		{headHeaderKey, 9, store.LastHeader},
+		{headFastBlockKey, 7, store.LastFast},
+		{headFinalizedBlockKey, 3, store.LastFinalized},
+	}
+	for _, m := range markers {
+		h, err := kv.Get(headerHashKey(m.num))
+		if err != nil {
+			t.Fatal(err)
+		}
+		kv.Put(m.key, h)
+
+		header, err := m.header()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Number != m.num || !bytes.Equal(header.Hash[:], h) {
+			t.Fatalf("expected header %d for marker %s but found %d", m.num, m.key, header.Number)
+		}
+	}
+
+	// the last header is ahead of the head block
+	syncing, err := store.Syncing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !syncing {
+		t.Fatal("expected the node to be syncing")
+	}
+
+	h, _ := kv.Get(headerHashKey(9))
+	kv.Put(headBlockKey, h)
+	if syncing, err = store.Syncing(); err != nil || syncing {
+		t.Fatalf("expected the node to be synced: %v", err)
+	}
+
+	// the marker has an incorrect hash
+	kv.Put(headFinalizedBlockKey, []byte{0x1})
+	if _, err := store.LastFinalized(); err == nil {
+		t.Fatal("expected incorrect hash error")
+	}
+}
@@ -13,9 +13,27 @@ import (
 
 type Block struct {
 	Number   uint64
+	Hash     hash
 	Header   *Header
 	Body     *Body
 	Receipts Receipts
+
+	// TotalDifficulty is nil if the node does not store it
+	TotalDifficulty *big.Int
+}
+
+// RecoverSenders populates the From field of every transaction in the block
+// and the authorities of the set code transactions
+func (b *Block) RecoverSenders(chainID *big.Int) error {
+	for indx, txn := range b.Body.Transactions {
+		from, err := txn.Sender(chainID)
+		if err != nil {
+			return fmt.Errorf("failed to recover sender of txn %d: %v", indx, err)
+		}
+		txn.From = from
+		txn.RecoverAuthorities()
+	}
+	return nil
 }
 
 type hash [32]byte
@@ -26,20 +44,171 @@ func (h hash) String() string {
 
 type address [20]byte
 
+// BloomByteLength is the size of the logs bloom filter
+const BloomByteLength = 256
+
+// Bloom is the bloom filter of the addresses and topics of the logs in a block
+type Bloom [BloomByteLength]byte
+
+// Test returns false if 'data' (a log address or topic) is definitely not
+// in the bloom filter. A true value might be a false positive.
+func (b *Bloom) Test(data []byte) bool {
+	keccak := fastrlp.NewKeccak256()
+	keccak.Write(data)
+	buf := keccak.Sum(nil)
+
+	// the first three pairs of bytes of the hash select the bits
+	for i := 0; i < 6; i += 2 {
+		bit := binary.BigEndian.Uint16(buf[i:]) & 0x7ff
+		if b[BloomByteLength-1-int(bit/8)]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (a address) String() string {
 	return "0x" + hex.EncodeToString(a[:])
 }
 
+// ReceiptStatus is the execution result of a transaction
+type ReceiptStatus uint8
+
+const (
+	// ReceiptStatusFailed is the status of a reverted transaction
+	ReceiptStatusFailed ReceiptStatus = iota
+	// ReceiptStatusSuccessful is the status of a successful transaction
+	ReceiptStatusSuccessful
+	// ReceiptStatusUnknown is the status of pre-byzantium receipts,
+	// which store the post state root instead
+	ReceiptStatusUnknown
+)
+
+func (r ReceiptStatus) String() string {
+	switch r {
+	case ReceiptStatusFailed:
+		return "failed"
+	case ReceiptStatusSuccessful:
+		return "successful"
+	default:
+		return "unknown"
+	}
+}
+
 type Receipt struct {
+	Type              TransactionType
 	PostStateOrStatus []byte
+	Status            ReceiptStatus
+	PostState         *hash
 	CumulativeGasUsed uint64
 	Logs              []*Log
+
+	// derived fields (see Block.DeriveFields)
+	TxHash            hash
+	TransactionIndex  uint64
+	GasUsed           uint64
+	EffectiveGasPrice *big.Int
+	ContractAddress   *address
+	BlobGasUsed       uint64
+	BlockHash         hash
+	BlockNumber       uint64
 }
 
 type Log struct {
 	Address address
 	Topics  []hash
 	Data    []byte
+
+	// derived fields (see Block.DeriveFields)
+	BlockNumber uint64
+	BlockHash   hash
+	TxHash      hash
+	TxIndex     uint64
+	Index       uint64
+}
+
+// blobGasPerBlob is the gas consumed by each blob (eip-4844)
+const blobGasPerBlob = 1 << 17
+
+// DeriveFields fills the receipt and log fields that are not stored on disk
+// but can be computed from the block and its transactions, the same way geth
+// does before serving them over RPC. The sender of contract creation
+// transactions is recovered to compute the contract address. It requires
+// the header, the body and the receipts of the block.
+func (b *Block) DeriveFields(chainID *big.Int) error {
+	if b.Header == nil {
+		return fmt.Errorf("header of block %d not read", b.Number)
+	}
+	if b.Body == nil {
+		return fmt.Errorf("body of block %d not read", b.Number)
+	}
+	txns := b.Body.Transactions
+	if b.Receipts == nil && len(txns) != 0 {
+		// the receipts of an empty block decode to nil
+		return fmt.Errorf("receipts of block %d not read", b.Number)
+	}
+	if len(txns) != len(b.Receipts) {
+		return fmt.Errorf("transaction and receipt count mismatch: %d != %d", len(txns), len(b.Receipts))
+	}
+
+	var logIndex uint64
+	for indx, receipt := range b.Receipts {
+		txn := txns[indx]
+
+		receipt.Type = txn.Type
+		receipt.TxHash = txn.Hash
+		receipt.TransactionIndex = uint64(indx)
+		receipt.EffectiveGasPrice = txn.EffectiveGasPrice(b.Header.BaseFee)
+		receipt.BlobGasUsed = uint64(len(txn.BlobVersionedHashes)) * blobGasPerBlob
+		receipt.BlockHash = b.Header.Hash
+		receipt.BlockNumber = b.Number
+
+		// the gas used is the difference between cumulative gas values
+		receipt.GasUsed = receipt.CumulativeGasUsed
+		if indx != 0 {
+			receipt.GasUsed -= b.Receipts[indx-1].CumulativeGasUsed
+		}
+
+		if txn.To == nil {
+			// contract creation
+			from, err := txn.Sender(chainID)
+			if err != nil {
+				return fmt.Errorf("failed to recover sender of txn %d: %v", indx, err)
+			}
+			txn.From = from
+
+			contractAddr := createAddress(from, txn.Nonce)
+			receipt.ContractAddress = &contractAddr
+		} else {
+			receipt.ContractAddress = nil
+		}
+
+		for _, log := range receipt.Logs {
+			log.BlockNumber = b.Number
+			log.BlockHash = b.Header.Hash
+			log.TxHash = txn.Hash
+			log.TxIndex = uint64(indx)
+			log.Index = logIndex
+			logIndex++
+		}
+	}
+	return nil
+}
+
+// createAddress returns the address of a contract created by 'from' with the given nonce
+func createAddress(from address, nonce uint64) address {
+	a := &fastrlp.Arena{}
+
+	v := a.NewArray()
+	v.Set(a.NewCopyBytes(from[:]))
+	v.Set(a.NewUint(nonce))
+
+	keccak := fastrlp.NewKeccak256()
+	keccak.Write(v.MarshalTo(nil))
+
+	var addr address
+	copy(addr[:], keccak.Sum(nil)[12:])
+	return addr
 }
 
 type Receipts []*Receipt
@@ -82,7 +251,22 @@ func (r *Receipt) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) error {
 	if err != nil {
 		return err
 	}
-	r.PostStateOrStatus = buf
+	// copy the value, the buffer of the parser might be reused
+	r.PostStateOrStatus = append(r.PostStateOrStatus[:0], buf...)
+
+	switch {
+	case len(buf) == 32:
+		// pre-byzantium post state root
+		r.Status = ReceiptStatusUnknown
+		r.PostState = new(hash)
+		copy(r.PostState[:], buf)
+	case len(buf) == 0:
+		r.Status = ReceiptStatusFailed
+	case len(buf) == 1 && buf[0] == 0x1:
+		r.Status = ReceiptStatusSuccessful
+	default:
+		return fmt.Errorf("invalid receipt status %x", buf)
+	}
 
 	// cumulativeGasUsed
 	if r.CumulativeGasUsed, err = elems[1].GetUint64(); err != nil {
@@ -135,6 +319,24 @@ func (l *Log) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) error {
 	return nil
 }
 
+// decodeTotalDifficulty decodes the rlp encoded total difficulty of a block
+func decodeTotalDifficulty(buf []byte) (*big.Int, error) {
+	td := new(big.Int)
+	if err := (*totalDifficulty)(td).UnmarshalRLP(buf); err != nil {
+		return nil, err
+	}
+	return td, nil
+}
+
+// totalDifficulty decodes the items of the diffs freezer table
+type totalDifficulty big.Int
+
+func (t *totalDifficulty) UnmarshalRLP(buf []byte) error {
+	return unmarshalRlp(func(p *fastrlp.Parser, v *fastrlp.Value) error {
+		return v.GetBigInt((*big.Int)(t))
+	}, buf)
+}
+
 type unmarshalRLPFunc func(p *fastrlp.Parser, v *fastrlp.Value) error
 
 func unmarshalRlp(obj unmarshalRLPFunc, input []byte) error {
@@ -164,6 +366,44 @@ func exists(name string) (bool, error) {
 type Body struct {
 	Transactions []*Transaction
 	Uncles       []*Header
+	Withdrawals  []*Withdrawal
+}
+
+// Withdrawal is a validator withdrawal from the consensus layer (eip-4895)
+type Withdrawal struct {
+	Index     uint64
+	Validator uint64
+	Address   address
+	// Amount is denominated in gwei
+	Amount uint64
+}
+
+func (w *Withdrawal) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) error {
+	elems, err := v.GetElems()
+	if err != nil {
+		return err
+	}
+	if len(elems) != 4 {
+		return fmt.Errorf("not enough elements to decode withdrawal, expected 4 but found %d", len(elems))
+	}
+
+	// index
+	if w.Index, err = elems[0].GetUint64(); err != nil {
+		return err
+	}
+	// validator index
+	if w.Validator, err = elems[1].GetUint64(); err != nil {
+		return err
+	}
+	// address
+	if err = elems[2].GetAddr(w.Address[:]); err != nil {
+		return err
+	}
+	// amount
+	if w.Amount, err = elems[3].GetUint64(); err != nil {
+		return err
+	}
+	return nil
 }
 
 func (b *Body) UnmarshalRLP(input []byte) error {
@@ -175,8 +415,8 @@ func (b *Body) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) error {
 	if err != nil {
 		return err
 	}
-	if len(tuple) != 2 {
-		return fmt.Errorf("not enough elements to decode header, expected 15 but found %d", len(tuple))
+	if len(tuple) != 2 && len(tuple) != 3 {
+		return fmt.Errorf("not enough elements to decode body, expected 2 or 3 but found %d", len(tuple))
 	}
 
 	// transactions
@@ -205,6 +445,22 @@ func (b *Body) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) error {
 		b.Uncles = append(b.Uncles, bUncle)
 	}
 
+	if len(tuple) == 3 {
+		// withdrawals
+		withdrawals, err := tuple[2].GetElems()
+		if err != nil {
+			return err
+		}
+		b.Withdrawals = make([]*Withdrawal, 0, len(withdrawals))
+		for _, withdrawal := range withdrawals {
+			bWithdrawal := &Withdrawal{}
+			if err := bWithdrawal.UnmarshalRLPFrom(p, withdrawal); err != nil {
+				return err
+			}
+			b.Withdrawals = append(b.Withdrawals, bWithdrawal)
+		}
+	}
+
 	return nil
 }
 
@@ -216,6 +472,10 @@ const (
 	TransactionAccessList TransactionType = 1
 	// eip-1559
 	TransactionDynamicFee TransactionType = 2
+	// eip-4844
+	TransactionBlob TransactionType = 3
+	// eip-7702
+	TransactionSetCode TransactionType = 4
 )
 
 type Transaction struct {
@@ -241,6 +501,29 @@ type Transaction struct {
 	// eip-1559 values
 	MaxPriorityFeePerGas *big.Int
 	MaxFeePerGas         *big.Int
+
+	// eip-4844 values
+	MaxFeePerBlobGas    *big.Int
+	BlobVersionedHashes []hash
+
+	// eip-7702 values
+	AuthorizationList AuthorizationList
+}
+
+// EffectiveGasPrice returns the gas price paid by the transaction
+// given the base fee of the block
+func (t *Transaction) EffectiveGasPrice(baseFee *big.Int) *big.Int {
+	if t.Type == TransactionLegacy || t.Type == TransactionAccessList {
+		return new(big.Int).SetUint64(t.GasPrice)
+	}
+	if baseFee == nil {
+		return new(big.Int).Set(t.MaxFeePerGas)
+	}
+	price := new(big.Int).Add(baseFee, t.MaxPriorityFeePerGas)
+	if price.Cmp(t.MaxFeePerGas) > 0 {
+		price.Set(t.MaxFeePerGas)
+	}
+	return price
 }
 
 type AccessEntry struct {
@@ -269,6 +552,10 @@ func (t *Transaction) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) erro
 			t.Type = TransactionAccessList
 		case 2:
 			t.Type = TransactionDynamicFee
+		case 3:
+			t.Type = TransactionBlob
+		case 4:
+			t.Type = TransactionSetCode
 		default:
 			return fmt.Errorf("type byte %d not found", typ)
 		}
@@ -279,6 +566,12 @@ func (t *Transaction) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) erro
 			return err
 		}
 
+		if t.Type == TransactionBlob && v.Elems() == 4 && v.Get(0).Type() == fastrlp.TypeArray {
+			// network form with the blob sidecar (tx, blobs, commitments, proofs),
+			// the hash only covers the transaction
+			v = v.Get(0)
+		}
+
 		keccak.Write([]byte{byte(t.Type)})
 		keccak.Write(pp.Raw(v))
 	} else {
@@ -308,6 +601,12 @@ func (t *Transaction) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) erro
 	case TransactionDynamicFee:
 		// access list txn + gas fee 1 + gas fee 2 - gas price
 		num = 12
+	case TransactionBlob:
+		// dynamic fee txn + max fee per blob gas + blob hashes
+		num = 14
+	case TransactionSetCode:
+		// dynamic fee txn + authorization list
+		num = 13
 	default:
 		return fmt.Errorf("transaction type %d not found", t.Type)
 	}
@@ -327,7 +626,7 @@ func (t *Transaction) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) erro
 		return err
 	}
 
-	if t.Type == TransactionDynamicFee {
+	if t.Type == TransactionDynamicFee || t.Type == TransactionBlob || t.Type == TransactionSetCode {
 		// dynamic fee uses
 		t.MaxPriorityFeePerGas = new(big.Int)
 		if err := getElem().GetBigInt(t.MaxPriorityFeePerGas); err != nil {
@@ -375,6 +674,31 @@ func (t *Transaction) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) erro
 		}
 	}
 
+	if t.Type == TransactionBlob {
+		// max fee per blob gas
+		t.MaxFeePerBlobGas = new(big.Int)
+		if err := getElem().GetBigInt(t.MaxFeePerBlobGas); err != nil {
+			return err
+		}
+		// blob versioned hashes
+		hashesElems, err := getElem().GetElems()
+		if err != nil {
+			return err
+		}
+		t.BlobVersionedHashes = make([]hash, len(hashesElems))
+		for indx, elem := range hashesElems {
+			if err := elem.GetHash(t.BlobVersionedHashes[indx][:]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if t.Type == TransactionSetCode {
+		if err := t.AuthorizationList.UnmarshalRLPWith(getElem()); err != nil {
+			return err
+		}
+	}
+
 	// V
 	if t.V, err = getElem().GetBytes(t.V); err != nil {
 		return err
@@ -437,6 +761,105 @@ func (a *AccessList) UnmarshalRLPWith(v *fastrlp.Value) error {
 	return nil
 }
 
+// Authorization is a signed delegation of an EOA to the code of
+// Address (eip-7702)
+type Authorization struct {
+	ChainID *big.Int
+	Address address
+	Nonce   uint64
+	V       byte
+	R       *big.Int
+	S       *big.Int
+
+	// Authority is the account that signed the authorization, it is only set
+	// by Transaction.RecoverAuthorities. It is nil if the signature is not valid,
+	// in which case the authorization is skipped by the protocol.
+	Authority *address
+}
+
+type AuthorizationList []*Authorization
+
+// signingHash returns the hash signed by the authority
+func (a *Authorization) signingHash() []byte {
+	ar := &fastrlp.Arena{}
+
+	v := ar.NewArray()
+	v.Set(ar.NewBigInt(a.ChainID))
+	v.Set(ar.NewCopyBytes(a.Address[:]))
+	v.Set(ar.NewUint(a.Nonce))
+
+	return signingHash([]byte{0x05}, v)
+}
+
+// recoverAuthority recovers the address that signed the authorization
+func (a *Authorization) recoverAuthority() (address, error) {
+	return ecrecover(a.signingHash(), a.R, a.S, a.V, true)
+}
+
+func (a *Authorization) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) error {
+	elems, err := v.GetElems()
+	if err != nil {
+		return err
+	}
+	if len(elems) != 6 {
+		return fmt.Errorf("not enough elements to decode authorization, expected 6 but found %d", len(elems))
+	}
+
+	// chain id
+	a.ChainID = new(big.Int)
+	if err := elems[0].GetBigInt(a.ChainID); err != nil {
+		return err
+	}
+	// address
+	if err := elems[1].GetAddr(a.Address[:]); err != nil {
+		return err
+	}
+	// nonce
+	if a.Nonce, err = elems[2].GetUint64(); err != nil {
+		return err
+	}
+	// y parity
+	yParity, err := elems[3].GetUint64()
+	if err != nil {
+		return err
+	}
+	if yParity > 0xFF {
+		return fmt.Errorf("y parity %d too large", yParity)
+	}
+	a.V = byte(yParity)
+	// R
+	a.R = new(big.Int)
+	if err := elems[4].GetBigInt(a.R); err != nil {
+		return err
+	}
+	// S
+	a.S = new(big.Int)
+	if err := elems[5].GetBigInt(a.S); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *AuthorizationList) UnmarshalRLPWith(v *fastrlp.Value) error {
+	if v.Type() == fastrlp.TypeArrayNull {
+		// empty
+		return nil
+	}
+
+	elems, err := v.GetElems()
+	if err != nil {
+		return err
+	}
+	for _, elem := range elems {
+		auth := &Authorization{}
+		if err := auth.UnmarshalRLPFrom(nil, elem); err != nil {
+			return err
+		}
+		(*a) = append((*a), auth)
+	}
+	return nil
+}
+
 type Header struct {
 	Hash         hash
 	ParentHash   hash
@@ -445,8 +868,8 @@ type Header struct {
 	StateRoot    hash
 	TxRoot       hash
 	ReceiptsRoot hash
-	LogsBloom    [32]byte
-	Difficulty   uint64
+	LogsBloom    Bloom
+	Difficulty   *big.Int
 	Number       uint64
 	GasLimit     uint64
 	GasUsed      uint64
@@ -454,7 +877,20 @@ type Header struct {
 	ExtraData    []byte
 	MixHash      hash
 	Nonce        [8]byte
-	BaseFee      *big.Int
+
+	// eip-1559 (london)
+	BaseFee *big.Int
+
+	// eip-4895 (shanghai)
+	WithdrawalsHash *hash
+
+	// eip-4844 and eip-4788 (cancun)
+	BlobGasUsed      *uint64
+	ExcessBlobGas    *uint64
+	ParentBeaconRoot *hash
+
+	// eip-7685 (prague)
+	RequestsHash *hash
 }
 
 func (h *Header) UnmarshalRLP(input []byte) error {
@@ -467,8 +903,8 @@ func (h *Header) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) error {
 		return err
 	}
 	num := len(elems)
-	if num != 15 && num != 16 {
-		return fmt.Errorf("not enough elements to decode header, expected 15 or 16 but found %d", num)
+	if num < 15 || num > 21 {
+		return fmt.Errorf("unexpected number of elements to decode header, expected between 15 and 21 but found %d", num)
 	}
 
 	p.Hash(h.Hash[:0], v)
@@ -502,7 +938,8 @@ func (h *Header) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) error {
 		return err
 	}
 	// difficulty
-	if h.Difficulty, err = elems[7].GetUint64(); err != nil {
+	h.Difficulty = new(big.Int)
+	if err = elems[7].GetBigInt(h.Difficulty); err != nil {
 		return err
 	}
 	// number
@@ -536,13 +973,50 @@ func (h *Header) UnmarshalRLPFrom(p *fastrlp.Parser, v *fastrlp.Value) error {
 	}
 	binary.BigEndian.PutUint64(h.Nonce[:], nonce)
 
-	if num == 16 {
+	if num > 15 {
 		// base fee
 		h.BaseFee = new(big.Int)
 		if err := elems[15].GetBigInt(h.BaseFee); err != nil {
 			return err
 		}
 	}
+	if num > 16 {
+		// withdrawals hash
+		h.WithdrawalsHash = new(hash)
+		if err := elems[16].GetHash(h.WithdrawalsHash[:]); err != nil {
+			return err
+		}
+	}
+	if num > 17 {
+		// blob gas used
+		blobGasUsed, err := elems[17].GetUint64()
+		if err != nil {
+			return err
+		}
+		h.BlobGasUsed = &blobGasUsed
+	}
+	if num > 18 {
+		// excess blob gas
+		excessBlobGas, err := elems[18].GetUint64()
+		if err != nil {
+			return err
+		}
+		h.ExcessBlobGas = &excessBlobGas
+	}
+	if num > 19 {
+		// parent beacon root
+		h.ParentBeaconRoot = new(hash)
+		if err := elems[19].GetHash(h.ParentBeaconRoot[:]); err != nil {
+			return err
+		}
+	}
+	if num > 20 {
+		// requests hash
+		h.RequestsHash = new(hash)
+		if err := elems[20].GetHash(h.RequestsHash[:]); err != nil {
+			return err
+		}
+	}
 
 	return err
 }
@@ -5,7 +5,11 @@ import (
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
+	"math/big"
+	"strings"
 	"testing"
+
+	"github.com/umbracle/fastrlp"
 )
 
 //go:embed fixtures/transactions.json
@@ -15,6 +19,7 @@ func TestTypesTxn(t *testing.T) {
 	var cases []struct {
 		Raw  string
 		Hash string
+		From string
 	}
 	if err := json.Unmarshal([]byte(transactionsFixtures), &cases); err != nil {
 		t.Fatal(err)
@@ -32,5 +37,316 @@ func TestTypesTxn(t *testing.T) {
 		if !bytes.Equal(hashHex, txn.Hash[:]) {
 			t.Fatal("not equal")
 		}
+
+		from, err := txn.Sender(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(from[:]) != c.From {
+			t.Fatalf("bad sender, expected %s but found %s", c.From, from)
+		}
+	}
+}
+
+func TestTypesHeader_Forks(t *testing.T) {
+	a := &fastrlp.Arena{}
+
+	root := make([]byte, 32)
+	root[0] = 0x1
+
+	fields := []*fastrlp.Value{
+		a.NewUint(7),         // base fee
+		a.NewCopyBytes(root), // withdrawals hash
+		a.NewUint(131072),    // blob gas used
+		a.NewUint(0),         // excess blob gas
+		a.NewCopyBytes(root), // parent beacon root
+		a.NewCopyBytes(root), // requests hash
+	}
+
+	for i := 0; i <= len(fields); i++ {
+		var header Header
+		if err := header.UnmarshalRLP(mockHeaderRLP(1, fields[:i]...)); err != nil {
+			t.Fatal(err)
+		}
+
+		if (header.BaseFee != nil) != (i > 0) {
+			t.Fatalf("%d: unexpected base fee", i)
+		}
+		if (header.WithdrawalsHash != nil) != (i > 1) {
+			t.Fatalf("%d: unexpected withdrawals hash", i)
+		}
+		if (header.BlobGasUsed != nil) != (i > 2) {
+			t.Fatalf("%d: unexpected blob gas used", i)
+		}
+		if (header.ExcessBlobGas != nil) != (i > 3) {
+			t.Fatalf("%d: unexpected excess blob gas", i)
+		}
+		if (header.ParentBeaconRoot != nil) != (i > 4) {
+			t.Fatalf("%d: unexpected parent beacon root", i)
+		}
+		if (header.RequestsHash != nil) != (i > 5) {
+			t.Fatalf("%d: unexpected requests hash", i)
+		}
+	}
+
+	var header Header
+	if err := header.UnmarshalRLP(mockHeaderRLP(1, fields...)); err != nil {
+		t.Fatal(err)
+	}
+	if *header.BlobGasUsed != 131072 {
+		t.Fatal("bad blob gas used")
+	}
+	if header.RequestsHash[0] != 0x1 {
+		t.Fatal("bad requests hash")
+	}
+
+	// a field from a fork that is not supported yet
+	err := header.UnmarshalRLP(mockHeaderRLP(1, append(fields, a.NewUint(1))...))
+	if err == nil || !strings.Contains(err.Error(), "expected between 15 and 21 but found 22") {
+		t.Fatalf("expected unexpected number of elements error but found %v", err)
+	}
+}
+
+func TestTypesBody_Withdrawals(t *testing.T) {
+	a := &fastrlp.Arena{}
+
+	addr := make([]byte, 20)
+	addr[19] = 0x1
+
+	withdrawal := a.NewArray()
+	withdrawal.Set(a.NewUint(10))
+	withdrawal.Set(a.NewUint(20))
+	withdrawal.Set(a.NewCopyBytes(addr))
+	withdrawal.Set(a.NewUint(30))
+
+	withdrawals := a.NewArray()
+	withdrawals.Set(withdrawal)
+
+	v := a.NewArray()
+	v.Set(a.NewArray())
+	v.Set(a.NewArray())
+	v.Set(withdrawals)
+
+	var body Body
+	if err := body.UnmarshalRLP(v.MarshalTo(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Withdrawals) != 1 {
+		t.Fatalf("expected 1 withdrawal but found %d", len(body.Withdrawals))
+	}
+	w := body.Withdrawals[0]
+	if w.Index != 10 || w.Validator != 20 || w.Address[19] != 0x1 || w.Amount != 30 {
+		t.Fatal("bad withdrawal")
+	}
+}
+
+func TestTypesTxn_Blob(t *testing.T) {
+	raw, _ := hex.DecodeString("b8f203f8ef0105843b9aca008506fc23ac0082520894095e7baea6a9c7c4c2dfeb977efac326af552d8780820102f838f794095e7baea6a9c7c4c2dfeb977efac326af552d87e1a0010000000000000000000000000000000000000000000000000000000000000084b2d05e00f842a001a915e4d060149eb4365960e6a7a45f334393093061116b197e3240065ff2d8a0010000000000000000000000000000000000000000000000000000000000000201a0fdd971ac0c6fd64a2f59e26c9050a26423e3e456568d8df3347c4f8fb1cf9916a05ec9d1e147e1ddcea9fd485140c48eba2a87fe81d0354a8160362499cb54d0ec")
+
+	var txn Transaction
+	if err := txn.UnmarshalRLP(raw); err != nil {
+		t.Fatal(err)
+	}
+	if txn.Type != TransactionBlob {
+		t.Fatalf("expected blob txn but found %d", txn.Type)
+	}
+	if txn.MaxFeePerBlobGas.Uint64() != 3_000_000_000 {
+		t.Fatal("bad max fee per blob gas")
+	}
+	if len(txn.BlobVersionedHashes) != 2 || txn.BlobVersionedHashes[1][31] != 0x2 {
+		t.Fatal("bad blob versioned hashes")
+	}
+}
+
+func TestTypesTxn_SetCode(t *testing.T) {
+	raw, _ := hex.DecodeString("b9012a04f901260105843b9aca008506fc23ac008301388094095e7baea6a9c7c4c2dfeb977efac326af552d878080c0f8b8f85a019463c0c19a282a1b52b07dd5a65b58948a07dae32b0301a0d06f09a012198aa9e36392356b1965a533ca61777eadd10f358846187604a3c0a05389c9800d61a0ef3b7214407c3edea1e40759a4a8b0fb08f3b795108c1dda40f85a809400000000000000000000000000000000000000000680a0dec2bddf300e91b305d30c763cd3c29f17ab20711e6c6cd4a137d8dfd3d68316a016846f950d75d5f1fdea2143e7ac47d84c9bc854fbbc7335a41876a4af60495c01a08820b6b420d62512b3928ac861a24cddc740a94ed29d39a5da2a381954897a3ba076997f0326dc1285435d2539284e589aa5e589281ba58fa9af668f2b4e696665")
+
+	var txn Transaction
+	if err := txn.UnmarshalRLP(raw); err != nil {
+		t.Fatal(err)
+	}
+	if txn.Type != TransactionSetCode {
+		t.Fatalf("expected set code txn but found %d", txn.Type)
+	}
+
+	authorities := []string{
+		"703c4b2bd70c169f5717101caee543299fc946c7",
+		"71562b71999873db5b286df957af199ec94617f7",
+	}
+	if len(txn.AuthorizationList) != len(authorities) {
+		t.Fatalf("expected %d authorizations but found %d", len(authorities), len(txn.AuthorizationList))
+	}
+	// the authorities are not recovered while decoding
+	for indx, auth := range txn.AuthorizationList {
+		if auth.Authority != nil {
+			t.Fatalf("%d: unexpected authority", indx)
+		}
+	}
+
+	block := &Block{Body: &Body{Transactions: []*Transaction{&txn}}}
+	if err := block.RecoverSenders(nil); err != nil {
+		t.Fatal(err)
+	}
+	for indx, auth := range txn.AuthorizationList {
+		if auth.Authority == nil {
+			t.Fatalf("%d: authority not recovered", indx)
+		}
+		if hex.EncodeToString(auth.Authority[:]) != authorities[indx] {
+			t.Fatalf("%d: bad authority %s", indx, auth.Authority)
+		}
+	}
+	if txn.AuthorizationList[0].Nonce != 3 || txn.AuthorizationList[1].ChainID.Sign() != 0 {
+		t.Fatal("bad authorization")
+	}
+}
+
+func TestBlock_DeriveFields(t *testing.T) {
+	var cases []struct {
+		Raw string
+	}
+	if err := json.Unmarshal([]byte(transactionsFixtures), &cases); err != nil {
+		t.Fatal(err)
+	}
+
+	// contract creation (legacy) and dynamic fee transactions
+	txns := []*Transaction{}
+	for _, indx := range []int{6, 1} {
+		raw, _ := hex.DecodeString(cases[indx].Raw)
+
+		txn := &Transaction{}
+		if err := txn.UnmarshalRLP(raw); err != nil {
+			t.Fatal(err)
+		}
+		txns = append(txns, txn)
+	}
+
+	block := &Block{
+		Number: 100,
+		Header: &Header{
+			Hash:    hash{0x1},
+			BaseFee: big.NewInt(10_000_000_000),
+		},
+		Body: &Body{
+			Transactions: txns,
+		},
+		Receipts: Receipts{
+			{CumulativeGasUsed: 60000, Logs: []*Log{{}, {}}},
+			{CumulativeGasUsed: 81000, Logs: []*Log{{}}},
+		},
+	}
+	if err := block.DeriveFields(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r0, r1 := block.Receipts[0], block.Receipts[1]
+	if r0.GasUsed != 60000 || r1.GasUsed != 21000 {
+		t.Fatal("bad gas used")
+	}
+	if r0.ContractAddress == nil || hex.EncodeToString(r0.ContractAddress[:]) != "880ec53af800b5cd051531672ef4fc4de233bd5d" {
+		t.Fatalf("bad contract address %v", r0.ContractAddress)
+	}
+	if r1.ContractAddress != nil {
+		t.Fatal("unexpected contract address")
+	}
+	if r0.EffectiveGasPrice.Uint64() != 20_000_000_000 {
+		t.Fatal("bad legacy effective gas price")
+	}
+
+	// base fee (10 gwei) + priority fee (1.41 gwei)
+	if r1.EffectiveGasPrice.Uint64() != 11_410_000_000 {
+		t.Fatalf("bad dynamic fee effective gas price %s", r1.EffectiveGasPrice)
+	}
+
+	if r1.TxHash != txns[1].Hash || r1.TransactionIndex != 1 || r1.BlockHash != block.Header.Hash {
+		t.Fatal("bad receipt fields")
+	}
+	if log := r1.Logs[0]; log.Index != 2 || log.TxIndex != 1 || log.TxHash != txns[1].Hash || log.BlockNumber != 100 {
+		t.Fatal("bad log fields")
+	}
+
+	// the fee cap binds when the base fee + priority fee are above it
+	block.Header.BaseFee = big.NewInt(153_000_000_000)
+	if err := block.DeriveFields(nil); err != nil {
+		t.Fatal(err)
+	}
+	if price := block.Receipts[1].EffectiveGasPrice.Uint64(); price != 153_966_860_153 {
+		t.Fatalf("bad capped effective gas price %d", price)
+	}
+	if block.Receipts[0].EffectiveGasPrice.Uint64() != 20_000_000_000 {
+		t.Fatal("bad legacy effective gas price")
+	}
+}
+
+func TestBlock_DeriveFieldsMissingParts(t *testing.T) {
+	txns := []*Transaction{{}}
+
+	cases := []*Block{
+		{Body: &Body{Transactions: txns}, Receipts: Receipts{{}}},
+		{Header: &Header{}, Receipts: Receipts{{}}},
+		{Header: &Header{}, Body: &Body{Transactions: txns}},
+	}
+	for indx, block := range cases {
+		if err := block.DeriveFields(nil); err == nil || !strings.Contains(err.Error(), "not read") {
+			t.Fatalf("%d: expected not read error but found %v", indx, err)
+		}
+	}
+
+	// an empty block has no receipts
+	block := &Block{Header: &Header{}, Body: &Body{}}
+	if err := block.DeriveFields(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypesReceipt_Status(t *testing.T) {
+	cases := []struct {
+		status    []byte
+		expected  ReceiptStatus
+		postState bool
+	}{
+		{[]byte{}, ReceiptStatusFailed, false},
+		{[]byte{0x1}, ReceiptStatusSuccessful, false},
+		{make([]byte, 32), ReceiptStatusUnknown, true},
+	}
+
+	for _, c := range cases {
+		a := &fastrlp.Arena{}
+
+		v := a.NewArray()
+		v.Set(a.NewCopyBytes(c.status))
+		v.Set(a.NewUint(21000))
+		v.Set(a.NewArray())
+
+		var receipt Receipt
+		if err := receipt.UnmarshalRLP(v.MarshalTo(nil)); err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != c.expected {
+			t.Fatalf("expected status %s but found %s", c.expected, receipt.Status)
+		}
+		if (receipt.PostState != nil) != c.postState {
+			t.Fatal("bad post state")
+		}
+	}
+}
+
+func TestTypesBloom(t *testing.T) {
+	buf, _ := hex.DecodeString("00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000001000000000000000000000000000000000008000000000000000000000000000000000000000000000000004000000000000000000000000000000000000000000010000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000002000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
+
+	var bloom Bloom
+	copy(bloom[:], buf)
+
+	addr, _ := hex.DecodeString("095e7baea6a9c7c4c2dfeb977efac326af552d87")
+	topic, _ := hex.DecodeString("ddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+	other, _ := hex.DecodeString("71562b71999873db5b286df957af199ec94617f7")
+
+	if !bloom.Test(addr) {
+		t.Fatal("address not found")
+	}
+	if !bloom.Test(topic) {
+		t.Fatal("topic not found")
+	}
+	if bloom.Test(other) {
+		t.Fatal("unexpected address found")
 	}
 }
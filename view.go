@@ -0,0 +1,421 @@
+package gethdatalayer
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/umbracle/fastrlp"
+)
+
+// RawBlock is a view over the rlp encoded header, body and receipts of a block
+// that only decodes the fields that are accessed. The iterators reuse the same
+// RawBlock and its parsers for all the blocks, so the views and the bytes they
+// return are only valid until the next call to Next.
+type RawBlock struct {
+	Number uint64
+	Hash   hash
+
+	// the raw parts of the block, nil if they were not read
+	header   []byte
+	body     []byte
+	receipts []byte
+
+	// the body and the receipts are parsed on the first access
+	bodyParser     fastrlp.Parser
+	bodyVal        *fastrlp.Value
+	receiptsParser fastrlp.Parser
+	receiptsVal    *fastrlp.Value
+
+	// txs and log are reused between blocks to keep their parsers
+	txs       []TxView
+	txsParsed bool
+	log       LogView
+}
+
+func (r *RawBlock) reset(num uint64, h hash, header, body, receipts []byte) {
+	r.Number = num
+	r.Hash = h
+	r.header = header
+	r.body = body
+	r.receipts = receipts
+	r.bodyVal = nil
+	r.receiptsVal = nil
+	r.txsParsed = false
+}
+
+// HeaderRLP returns the rlp encoded header
+func (r *RawBlock) HeaderRLP() []byte {
+	return r.header
+}
+
+// BodyRLP returns the rlp encoded body
+func (r *RawBlock) BodyRLP() []byte {
+	return r.body
+}
+
+// ReceiptsRLP returns the rlp encoded receipts in the geth storage format
+func (r *RawBlock) ReceiptsRLP() []byte {
+	return r.receipts
+}
+
+// Header decodes the header of the block
+func (r *RawBlock) Header() (*Header, error) {
+	if r.header == nil {
+		return nil, fmt.Errorf("header of block %d not read", r.Number)
+	}
+	header := new(Header)
+	if err := header.UnmarshalRLP(r.header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func (r *RawBlock) parseBody() (*fastrlp.Value, error) {
+	if r.bodyVal != nil {
+		return r.bodyVal, nil
+	}
+	if r.body == nil {
+		return nil, fmt.Errorf("body of block %d not read", r.Number)
+	}
+	v, err := r.bodyParser.Parse(r.body)
+	if err != nil {
+		return nil, err
+	}
+	if v.Type() != fastrlp.TypeArray || v.Elems() < 2 {
+		return nil, fmt.Errorf("incorrect body")
+	}
+	r.bodyVal = v
+	return v, nil
+}
+
+func (r *RawBlock) parseReceipts() (*fastrlp.Value, error) {
+	if r.receiptsVal != nil {
+		return r.receiptsVal, nil
+	}
+	if r.receipts == nil {
+		return nil, fmt.Errorf("receipts of block %d not read", r.Number)
+	}
+	v, err := r.receiptsParser.Parse(r.receipts)
+	if err != nil {
+		return nil, err
+	}
+	if v.Type() != fastrlp.TypeArray {
+		return nil, fmt.Errorf("incorrect receipts")
+	}
+	r.receiptsVal = v
+	return v, nil
+}
+
+func (r *RawBlock) parseTransactions() error {
+	if r.txsParsed {
+		return nil
+	}
+	body, err := r.parseBody()
+	if err != nil {
+		return err
+	}
+	elems, err := body.Get(0).GetElems()
+	if err != nil {
+		return err
+	}
+
+	// reuse the views (and their parsers) of the previous blocks
+	if cap(r.txs) < len(elems) {
+		r.txs = append(r.txs[:cap(r.txs)], make([]TxView, len(elems)-cap(r.txs))...)
+	}
+	r.txs = r.txs[:len(elems)]
+	for indx, elem := range elems {
+		if err := r.txs[indx].reset(&r.bodyParser, elem); err != nil {
+			return fmt.Errorf("failed to parse txn %d: %v", indx, err)
+		}
+	}
+	r.txsParsed = true
+	return nil
+}
+
+// NumTransactions returns the number of transactions in the block
+func (r *RawBlock) NumTransactions() (int, error) {
+	if err := r.parseTransactions(); err != nil {
+		return 0, err
+	}
+	return len(r.txs), nil
+}
+
+// Transaction returns a view of the transaction 'indx'
+func (r *RawBlock) Transaction(indx int) (*TxView, error) {
+	if err := r.parseTransactions(); err != nil {
+		return nil, err
+	}
+	if indx < 0 || indx >= len(r.txs) {
+		return nil, fmt.Errorf("transaction %d not found, the block has %d", indx, len(r.txs))
+	}
+	return &r.txs[indx], nil
+}
+
+// Logs calls fn with a view of every log in the block. The view is reused
+// between calls. It stops at the first error returned by fn.
+func (r *RawBlock) Logs(fn func(log *LogView) error) error {
+	receipts, err := r.parseReceipts()
+	if err != nil {
+		return err
+	}
+
+	logIndex := uint64(0)
+	for txIndex := 0; txIndex < receipts.Elems(); txIndex++ {
+		receipt := receipts.Get(txIndex)
+		if receipt.Type() != fastrlp.TypeArray || receipt.Elems() != 3 {
+			return fmt.Errorf("incorrect receipt %d", txIndex)
+		}
+		logs, err := receipt.Get(2).GetElems()
+		if err != nil {
+			return err
+		}
+		for _, log := range logs {
+			if log.Type() != fastrlp.TypeArray || log.Elems() != 3 || log.Get(1).Type() != fastrlp.TypeArray {
+				return fmt.Errorf("incorrect log %d", logIndex)
+			}
+			r.log = LogView{
+				TxIndex: uint64(txIndex),
+				Index:   logIndex,
+				v:       log,
+			}
+			if err := fn(&r.log); err != nil {
+				return err
+			}
+			logIndex++
+		}
+	}
+	return nil
+}
+
+// TxView is a view over a rlp encoded transaction that decodes the
+// fields on access
+type TxView struct {
+	typ TransactionType
+
+	// v is the value of the transaction in the body, a list for legacy
+	// transactions and the bytes with the payload for typed ones
+	v          *fastrlp.Value
+	bodyParser *fastrlp.Parser
+
+	// fields is the list of fields, the payload of the typed
+	// transactions is parsed on the first access
+	fields *fastrlp.Value
+	parser fastrlp.Parser
+	keccak *fastrlp.Keccak
+
+	// typBuf holds the type prefix hashed with the typed transactions
+	typBuf [1]byte
+}
+
+func (t *TxView) reset(p *fastrlp.Parser, v *fastrlp.Value) error {
+	t.v = v
+	t.bodyParser = p
+	t.fields = nil
+
+	if v.Type() == fastrlp.TypeArray {
+		t.typ = TransactionLegacy
+		t.fields = v
+		return nil
+	}
+	buf, err := v.Bytes()
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 {
+		return fmt.Errorf("empty typed transaction")
+	}
+	// the legacy transactions are encoded as a list
+	if buf[0] < byte(TransactionAccessList) || buf[0] > byte(TransactionSetCode) {
+		return fmt.Errorf("transaction type %d not found", buf[0])
+	}
+	t.typ = TransactionType(buf[0])
+	return nil
+}
+
+func (t *TxView) parseFields() (*fastrlp.Value, error) {
+	if t.fields != nil {
+		return t.fields, nil
+	}
+	buf, _ := t.v.Bytes()
+
+	v, err := t.parser.Parse(buf[1:])
+	if err != nil {
+		return nil, err
+	}
+	if t.typ == TransactionBlob && v.Elems() == 4 && v.Get(0).Type() == fastrlp.TypeArray {
+		// network form with the blob sidecar
+		v = v.Get(0)
+	}
+	if v.Type() != fastrlp.TypeArray {
+		return nil, fmt.Errorf("incorrect transaction")
+	}
+	t.fields = v
+	return v, nil
+}
+
+// field returns the field of the transaction at position 'indx' for legacy
+// transactions, the typed transactions start with the chain id
+func (t *TxView) field(indx int) (*fastrlp.Value, error) {
+	fields, err := t.parseFields()
+	if err != nil {
+		return nil, err
+	}
+	if t.typ != TransactionLegacy {
+		// chain id
+		indx++
+		if t.typ != TransactionAccessList && indx > 1 {
+			// the gas price is replaced by two fee fields
+			indx++
+		}
+	}
+	if indx >= fields.Elems() {
+		return nil, fmt.Errorf("field %d not found", indx)
+	}
+	return fields.Get(indx), nil
+}
+
+// Type returns the type of the transaction
+func (t *TxView) Type() TransactionType {
+	return t.typ
+}
+
+// Hash returns the hash of the transaction
+func (t *TxView) Hash() (hash, error) {
+	var h hash
+
+	fields, err := t.parseFields()
+	if err != nil {
+		return h, err
+	}
+	if t.keccak == nil {
+		t.keccak = fastrlp.NewKeccak256()
+	}
+	t.keccak.Reset()
+	if t.typ == TransactionLegacy {
+		t.keccak.Write(t.bodyParser.Raw(fields))
+	} else {
+		t.typBuf[0] = byte(t.typ)
+		t.keccak.Write(t.typBuf[:])
+		t.keccak.Write(t.parser.Raw(fields))
+	}
+	t.keccak.Sum(h[:0])
+	return h, nil
+}
+
+// Nonce returns the nonce of the transaction
+func (t *TxView) Nonce() (uint64, error) {
+	v, err := t.field(0)
+	if err != nil {
+		return 0, err
+	}
+	return v.GetUint64()
+}
+
+// Gas returns the gas limit of the transaction
+func (t *TxView) Gas() (uint64, error) {
+	v, err := t.field(2)
+	if err != nil {
+		return 0, err
+	}
+	return v.GetUint64()
+}
+
+// To returns the recipient of the transaction, nil for contract creations
+func (t *TxView) To() (*address, error) {
+	v, err := t.field(3)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := v.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	if len(buf) != 20 {
+		return nil, fmt.Errorf("incorrect address length: %d", len(buf))
+	}
+	addr := new(address)
+	copy(addr[:], buf)
+	return addr, nil
+}
+
+// Value returns the value transferred by the transaction
+func (t *TxView) Value() (*big.Int, error) {
+	v, err := t.field(4)
+	if err != nil {
+		return nil, err
+	}
+	value := new(big.Int)
+	if err := v.GetBigInt(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Input returns the input data of the transaction. It is not copied.
+func (t *TxView) Input() ([]byte, error) {
+	v, err := t.field(5)
+	if err != nil {
+		return nil, err
+	}
+	return v.Bytes()
+}
+
+// Transaction decodes the whole transaction
+func (t *TxView) Transaction() (*Transaction, error) {
+	txn := new(Transaction)
+	if err := txn.UnmarshalRLPFrom(t.bodyParser, t.v); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+// LogView is a view over a rlp encoded log that decodes the fields on access
+type LogView struct {
+	// TxIndex is the index of the transaction that emitted the log
+	TxIndex uint64
+
+	// Index is the index of the log in the block
+	Index uint64
+
+	v *fastrlp.Value
+}
+
+// Address returns the address of the contract that emitted the log
+func (l *LogView) Address() (address, error) {
+	var addr address
+	err := l.v.Get(0).GetAddr(addr[:])
+	return addr, err
+}
+
+// NumTopics returns the number of topics of the log
+func (l *LogView) NumTopics() int {
+	return l.v.Get(1).Elems()
+}
+
+// Topic returns the topic 'indx' of the log
+func (l *LogView) Topic(indx int) (hash, error) {
+	var h hash
+	if indx < 0 || indx >= l.NumTopics() {
+		return h, fmt.Errorf("topic %d not found, the log has %d", indx, l.NumTopics())
+	}
+	err := l.v.Get(1).Get(indx).GetHash(h[:])
+	return h, err
+}
+
+// Data returns the data of the log. It is not copied.
+func (l *LogView) Data() ([]byte, error) {
+	return l.v.Get(2).Bytes()
+}
+
+// Log decodes the whole log
+func (l *LogView) Log() (*Log, error) {
+	log := new(Log)
+	if err := log.UnmarshalRLPFrom(nil, l.v); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
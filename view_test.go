@@ -0,0 +1,344 @@
+package gethdatalayer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/umbracle/fastrlp"
+)
+
+// mockViewBlock returns the rlp encoded body with the fixture transactions
+// [from, to) and the receipts with 'i' logs for the transaction 'i'
+func mockViewBlock(t *testing.T, from, to int) ([]byte, []byte) {
+	t.Helper()
+
+	var cases []struct {
+		Raw string
+	}
+	if err := json.Unmarshal([]byte(transactionsFixtures), &cases); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &fastrlp.Arena{}
+
+	txns := a.NewArray()
+	receipts := a.NewArray()
+	for i, c := range cases[from:to] {
+		raw, _ := hex.DecodeString(c.Raw)
+
+		p := &fastrlp.Parser{}
+		v, err := p.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txns.Set(v)
+
+		logs := a.NewArray()
+		for j := 0; j < i; j++ {
+			topics := a.NewArray()
+			for k := 0; k < j; k++ {
+				topics.Set(a.NewCopyBytes(bytes.Repeat([]byte{byte(k + 1)}, 32)))
+			}
+			log := a.NewArray()
+			log.Set(a.NewCopyBytes(bytes.Repeat([]byte{byte(i)}, 20)))
+			log.Set(topics)
+			log.Set(a.NewCopyBytes([]byte{byte(i), byte(j)}))
+			logs.Set(log)
+		}
+		receipt := a.NewArray()
+		receipt.Set(a.NewUint(1))
+		receipt.Set(a.NewUint(uint64(21000 * (i + 1))))
+		receipt.Set(logs)
+		receipts.Set(receipt)
+	}
+
+	body := a.NewArray()
+	body.Set(txns)
+	body.Set(a.NewArray())
+
+	return body.MarshalTo(nil), receipts.MarshalTo(nil)
+}
+
+// mockViewBlocks are the fixture transactions [from, to) of each block
+var mockViewBlocks = [][2]int{{0, 8}, {2, 5}, {1, 7}}
+
+func TestRawBlock(t *testing.T) {
+	kv := NewMemoryStore()
+	for num, txns := range mockViewBlocks {
+		body, receipts := mockViewBlock(t, txns[0], txns[1])
+		kv.PutBlock(uint64(num), mockHeaderRLP(uint64(num)), body, receipts)
+	}
+
+	store, err := NewStoreFromKV(kv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testRawBlockIterator(t, store.Iterator())
+}
+
+func TestRawBlock_Ancient(t *testing.T) {
+	path := t.TempDir()
+
+	var headers, bodies, receipts [][]byte
+	for num, txns := range mockViewBlocks {
+		body, receiptsRLP := mockViewBlock(t, txns[0], txns[1])
+
+		headers = append(headers, mockHeaderRLP(uint64(num)))
+		bodies = append(bodies, body)
+		receipts = append(receipts, receiptsRLP)
+	}
+	writeAncientTable(t, path, "headers", headers, true)
+	writeAncientTable(t, path, "bodies", bodies, true)
+	writeAncientTable(t, path, "receipts", receipts, true)
+
+	store, err := NewAncientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testRawBlockIterator(t, store.Iterator())
+}
+
+// testRawBlockIterator checks that the views of every block match the
+// decoded block
+func testRawBlockIterator(t *testing.T, iter Iterator) {
+	t.Helper()
+	defer iter.Close()
+
+	count := 0
+	for iter.Next() {
+		block, err := iter.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := iter.Raw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRawBlock(t, raw, block)
+		count++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(mockViewBlocks) {
+		t.Fatalf("expected %d blocks but found %d", len(mockViewBlocks), count)
+	}
+}
+
+func testRawBlock(t *testing.T, raw *RawBlock, block *Block) {
+	t.Helper()
+
+	if raw.Number != block.Number || raw.Hash != block.Hash {
+		t.Fatal("bad block")
+	}
+	header, err := raw.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Hash != block.Header.Hash {
+		t.Fatal("bad header")
+	}
+
+	num, err := raw.NumTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txns := mockViewBlocks[block.Number]
+	if expected := txns[1] - txns[0]; num != expected || len(block.Body.Transactions) != expected {
+		t.Fatalf("expected %d transactions but found %d", expected, num)
+	}
+	for indx, txn := range block.Body.Transactions {
+		view, err := raw.Transaction(indx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if view.Type() != txn.Type {
+			t.Fatalf("bad type of txn %d", indx)
+		}
+		if h, err := view.Hash(); err != nil || h != txn.Hash {
+			t.Fatalf("bad hash of txn %d: %v", indx, err)
+		}
+		if nonce, err := view.Nonce(); err != nil || nonce != txn.Nonce {
+			t.Fatalf("bad nonce of txn %d: %v", indx, err)
+		}
+		if gas, err := view.Gas(); err != nil || gas != txn.Gas {
+			t.Fatalf("bad gas of txn %d: %v", indx, err)
+		}
+		to, err := view.To()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (to == nil) != (txn.To == nil) || (to != nil && *to != *txn.To) {
+			t.Fatalf("bad to of txn %d", indx)
+		}
+		if value, err := view.Value(); err != nil || value.Cmp(txn.Value) != 0 {
+			t.Fatalf("bad value of txn %d: %v", indx, err)
+		}
+		if input, err := view.Input(); err != nil || !bytes.Equal(input, txn.Input) {
+			t.Fatalf("bad input of txn %d: %v", indx, err)
+		}
+		full, err := view.Transaction()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if full.Hash != txn.Hash {
+			t.Fatalf("bad decoded txn %d", indx)
+		}
+	}
+
+	logs := []*Log{}
+	txIndexes := []uint64{}
+	for txIndex, receipt := range block.Receipts {
+		for _, log := range receipt.Logs {
+			logs = append(logs, log)
+			txIndexes = append(txIndexes, uint64(txIndex))
+		}
+	}
+	count := 0
+	err = raw.Logs(func(view *LogView) error {
+		log := logs[view.Index]
+		if view.TxIndex != txIndexes[view.Index] {
+			t.Fatalf("bad tx index of log %d", view.Index)
+		}
+		if addr, err := view.Address(); err != nil || addr != log.Address {
+			t.Fatalf("bad address of log %d: %v", view.Index, err)
+		}
+		if view.NumTopics() != len(log.Topics) {
+			t.Fatalf("bad topics of log %d", view.Index)
+		}
+		for i, topic := range log.Topics {
+			if found, err := view.Topic(i); err != nil || found != topic {
+				t.Fatalf("bad topic %d of log %d: %v", i, view.Index, err)
+			}
+		}
+		if data, err := view.Data(); err != nil || !bytes.Equal(data, log.Data) {
+			t.Fatalf("bad data of log %d: %v", view.Index, err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(logs) {
+		t.Fatalf("expected %d logs but found %d", len(logs), count)
+	}
+}
+
+func TestRawBlock_IncorrectType(t *testing.T) {
+	for _, typ := range []byte{0x0, 0x5, 0x7f} {
+		a := &fastrlp.Arena{}
+
+		// typed transaction with an empty payload
+		txns := a.NewArray()
+		txns.Set(a.NewCopyBytes(append([]byte{typ}, mockEmptyListRLP(0)...)))
+
+		body := a.NewArray()
+		body.Set(txns)
+		body.Set(a.NewArray())
+
+		raw := &RawBlock{}
+		raw.reset(0, hash{}, nil, body.MarshalTo(nil), nil)
+
+		if _, err := raw.NumTransactions(); err == nil {
+			t.Fatalf("expected incorrect type error for type %d", typ)
+		}
+	}
+}
+
+func TestRawBlock_Allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+
+	body, receipts := mockViewBlock(t, 0, 8)
+
+	raw := &RawBlock{}
+	logFn := func(log *LogView) error {
+		if _, err := log.Address(); err != nil {
+			return err
+		}
+		for i := 0; i < log.NumTopics(); i++ {
+			if _, err := log.Topic(i); err != nil {
+				return err
+			}
+		}
+		_, err := log.Data()
+		return err
+	}
+	read := func() {
+		raw.reset(0, hash{}, nil, body, receipts)
+
+		num, err := raw.NumTransactions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < num; i++ {
+			view, err := raw.Transaction(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			view.Type()
+			if _, err := view.Hash(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := view.Nonce(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := view.Gas(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := view.Input(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := raw.Logs(logFn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first block allocates the parsers and the views
+	read()
+	if allocs := testing.AllocsPerRun(10, read); allocs != 0 {
+		t.Fatalf("expected no allocations per block but found %.1f", allocs)
+	}
+}
+
+func TestRawBlock_Parts(t *testing.T) {
+	store, err := NewAncientStore(newMockAncientStore(t, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	iter := store.Iterator(WithHeaders())
+	defer iter.Close()
+
+	iter.Seek(3)
+	if !iter.Next() {
+		t.Fatal("expected block 3")
+	}
+	raw, err := iter.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := raw.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Number != 3 || header.Number != 3 || raw.Hash != header.Hash {
+		t.Fatal("bad block")
+	}
+	if raw.BodyRLP() != nil {
+		t.Fatal("the body should not be read")
+	}
+	if _, err := raw.NumTransactions(); err == nil {
+		t.Fatal("expected body not read error")
+	}
+}